@@ -0,0 +1,21 @@
+package rbytree
+
+import (
+	"fmt"
+)
+
+// NewDebug creates new empty instance of Red-black tree that validates
+// itself after every insertion, deletion, rebuild and swap of its nodes,
+// whichever method makes it, and panics with the description of
+// the violation if the tree is not valid, see Validate. It makes these
+// operations O(n), so it is meant only for the development and tests.
+func NewDebug() *Tree {
+	return &Tree{debug: true}
+}
+
+// check panics if the tree is not valid after the operation.
+func (t *Tree) check(operation string) {
+	if err := t.Validate(); err != nil {
+		panic(fmt.Sprintf("tree is not valid after %s: %s", operation, err))
+	}
+}
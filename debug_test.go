@@ -0,0 +1,77 @@
+package rbytree
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewDebug(t *testing.T) {
+	tree := NewDebug()
+	for _, c := range treeCases {
+		tree.Put([]byte{c.key}, []byte(c.value))
+	}
+	for _, c := range treeCases {
+		tree.Delete([]byte{c.key})
+	}
+
+	if tree.Size() != 0 {
+		t.Fatalf("expected empty tree, but got size %d", tree.Size())
+	}
+}
+
+func TestNewDebugPanics(t *testing.T) {
+	operations := []struct {
+		name      string
+		diagnosis string
+		operation func(tree *Tree)
+	}{
+		{"Put", "after insertion", func(tree *Tree) {
+			tree.Put([]byte{255}, nil)
+		}},
+		{"Delete", "after deletion", func(tree *Tree) {
+			tree.Delete([]byte{treeCases[0].key})
+		}},
+		{"Remove", "after deletion", func(tree *Tree) {
+			tree.Remove([]byte{treeCases[0].key})
+		}},
+		{"DeleteFunc", "after deletion", func(tree *Tree) {
+			tree.DeleteFunc(func(key, value []byte) bool {
+				return true
+			})
+		}},
+		{"Swap", "after Swap", func(tree *Tree) {
+			tree.Swap(NewDebug())
+		}},
+	}
+
+	for _, o := range operations {
+		tree := NewDebug()
+		for _, c := range treeCases {
+			tree.Put([]byte{c.key}, []byte(c.value))
+		}
+		tree.size += 10
+
+		func() {
+			defer func() {
+				r := recover()
+				if r == nil {
+					t.Fatalf("expected %s to panic", o.name)
+				}
+				if message, _ := r.(string); !strings.Contains(message, o.diagnosis) {
+					t.Fatalf("expected diagnostic for %s, but got %v", o.name, r)
+				}
+			}()
+
+			o.operation(tree)
+		}()
+	}
+}
+
+func TestNewDoesNotValidate(t *testing.T) {
+	tree := New()
+	tree.Put([]byte{1}, nil)
+	tree.size += 10
+
+	tree.Put([]byte{2}, nil)
+	tree.Delete([]byte{2})
+}
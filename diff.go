@@ -0,0 +1,48 @@
+package rbytree
+
+import (
+	"bytes"
+)
+
+// ChangeType is the type of the change between two trees reported by Diff.
+type ChangeType byte
+
+const (
+	// ChangeAdded is reported for a key that is only in the new tree.
+	ChangeAdded ChangeType = iota
+	// ChangeRemoved is reported for a key that is only in the old tree.
+	ChangeRemoved
+	// ChangeModified is reported for a key that is in both trees
+	// with different values.
+	ChangeModified
+)
+
+// Change is a change of a single key between two trees. OldValue is nil
+// for ChangeAdded and NewValue is nil for ChangeRemoved.
+type Change struct {
+	Type     ChangeType
+	Key      []byte
+	OldValue []byte
+	NewValue []byte
+}
+
+// Diff returns the changes turning oldTree into newTree in ascending
+// key order. The keys are copied, the values are returned as stored.
+// Only the first values of the keys of multi trees are compared. It walks
+// both trees in ascending key order at once, so it takes O(n + m) time.
+// The trees are not modified.
+func Diff(oldTree, newTree *Tree) []Change {
+	changes := make([]Change, 0)
+	walkBoth(oldTree, newTree, func(x, y *node) {
+		switch {
+		case y == nil:
+			changes = append(changes, Change{ChangeRemoved, copyBytes(x.key), x.value, nil})
+		case x == nil:
+			changes = append(changes, Change{ChangeAdded, copyBytes(y.key), nil, y.value})
+		case !bytes.Equal(x.value, y.value):
+			changes = append(changes, Change{ChangeModified, copyBytes(x.key), x.value, y.value})
+		}
+	})
+
+	return changes
+}
@@ -0,0 +1,58 @@
+package rbytree
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	oldTree, newTree := New(), New()
+	for k := 0; k < 10; k++ {
+		oldTree.Put([]byte{byte(k)}, []byte{byte(k)})
+	}
+	for k := 5; k < 15; k++ {
+		newTree.Put([]byte{byte(k)}, []byte{byte(k)})
+	}
+	newTree.Put([]byte{6}, []byte{60})
+	newTree.Put([]byte{8}, []byte{80})
+
+	expected := []Change{
+		{ChangeRemoved, []byte{0}, []byte{0}, nil},
+		{ChangeRemoved, []byte{1}, []byte{1}, nil},
+		{ChangeRemoved, []byte{2}, []byte{2}, nil},
+		{ChangeRemoved, []byte{3}, []byte{3}, nil},
+		{ChangeRemoved, []byte{4}, []byte{4}, nil},
+		{ChangeModified, []byte{6}, []byte{6}, []byte{60}},
+		{ChangeModified, []byte{8}, []byte{8}, []byte{80}},
+		{ChangeAdded, []byte{10}, nil, []byte{10}},
+		{ChangeAdded, []byte{11}, nil, []byte{11}},
+		{ChangeAdded, []byte{12}, nil, []byte{12}},
+		{ChangeAdded, []byte{13}, nil, []byte{13}},
+		{ChangeAdded, []byte{14}, nil, []byte{14}},
+	}
+
+	actual := Diff(oldTree, newTree)
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected %v, but got %v", expected, actual)
+	}
+
+	if changes := Diff(oldTree, oldTree); len(changes) != 0 {
+		t.Fatalf("expected no changes for the same tree, but got %v", changes)
+	}
+
+	if changes := Diff(New(), New()); len(changes) != 0 {
+		t.Fatalf("expected no changes for empty trees, but got %v", changes)
+	}
+}
+
+func TestDiffIgnoresTombstones(t *testing.T) {
+	oldTree, newTree := NewWithTombstones(), New()
+	oldTree.Put([]byte{1}, []byte{1})
+	oldTree.Put([]byte{2}, []byte{2})
+	oldTree.Delete([]byte{2})
+	newTree.Put([]byte{1}, []byte{1})
+
+	if changes := Diff(oldTree, newTree); len(changes) != 0 {
+		t.Fatalf("expected no changes, but got %v", changes)
+	}
+}
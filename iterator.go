@@ -1,22 +1,33 @@
 package rbytree
 
+import (
+	"errors"
+)
+
+// ErrStale is returned by CheckedIterator.Next if the tree has been
+// modified since the iterator was created.
+var ErrStale = errors.New("tree has been modified during iteration")
+
 // Iterator returns a stateful Iterator for traversing the tree
 // in ascending key order.
 type Iterator struct {
+	tree *Tree
 	next *node
+	// duplicate is the position of the next value among the duplicates
+	// of the next node, 0 stands for the first value of the node
+	duplicate int
+	version   uint64
 }
 
 // Iterator returns a stateful iterator that traverses the tree
 // in ascending key order.
 func (t *Tree) Iterator() *Iterator {
-	next := t.root
-	if next != nil {
-		for next.left != nil {
-			next = next.left
-		}
+	var next *node
+	if t.root != nil {
+		next = live(minimum(t.root))
 	}
 
-	return &Iterator{next}
+	return &Iterator{t, next, 0, t.version}
 }
 
 // HasNext returns true if there is a next element to retrive.
@@ -26,34 +37,67 @@ func (it *Iterator) HasNext() bool {
 
 // Next returns a key and a value at the current position of the iteration
 // and advances the iterator.
-// Caution! Next panics if called on the nil element.
+// Caution! Next panics if called on the nil element or if the tree
+// has been modified since the iterator was created.
 func (it *Iterator) Next() ([]byte, []byte) {
 	if !it.HasNext() {
 		// to sleep well
 		panic("there is no next node")
 	}
 
+	if it.version != it.tree.version {
+		panic("tree has been modified during iteration")
+	}
+
 	current := it.next
-	if it.next.right != nil {
-		it.next = it.next.right
-		for it.next.left != nil {
-			it.next = it.next.left
-		}
 
-		return current.key, current.value
+	value := current.value
+	if it.duplicate > 0 {
+		value = current.duplicates[it.duplicate-1]
 	}
 
-	for {
-		if it.next.parent == nil {
-			it.next = nil
+	if it.duplicate < len(current.duplicates) {
+		it.duplicate++
+	} else {
+		it.duplicate = 0
+		it.next = live(successor(current))
+	}
+
+	return current.key, value
+}
+
+// CheckedIterator is a stateful iterator like Iterator that returns
+// ErrStale instead of panicking if the tree has been modified.
+type CheckedIterator struct {
+	it *Iterator
+}
+
+// CheckedIterator returns a stateful iterator that traverses the tree
+// in ascending key order and detects the modifications of the tree
+// by the version captured on creation, so the caller can retry.
+// It only detects the modifications and does not isolate from them,
+// the tree is still not safe for concurrent use, so a writer in
+// another goroutine must be synchronized with the calls of Next,
+// for example, with sync.RWMutex.
+func (t *Tree) CheckedIterator() *CheckedIterator {
+	return &CheckedIterator{t.Iterator()}
+}
 
-			return current.key, current.value
-		}
-		if it.next.parent.left == it.next {
-			it.next = it.next.parent
+// HasNext returns true if there is a next element to retrive.
+func (it *CheckedIterator) HasNext() bool {
+	return it.it.HasNext()
+}
 
-			return current.key, current.value
-		}
-		it.next = it.next.parent
+// Next returns a key and a value at the current position of the iteration
+// and advances the iterator, or ErrStale if the tree has been modified
+// since the iterator was created, in which case the iterator does not
+// advance. Next panics if called on the nil element.
+func (it *CheckedIterator) Next() ([]byte, []byte, error) {
+	if it.it.HasNext() && it.it.version != it.it.tree.version {
+		return nil, nil, ErrStale
 	}
+
+	key, value := it.it.Next()
+
+	return key, value, nil
 }
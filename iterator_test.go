@@ -119,3 +119,106 @@ func TestIteratorNextPanicAfterIteration(t *testing.T) {
 	it.Next()
 	it.Next()
 }
+
+func TestIteratorNextPanicAfterModification(t *testing.T) {
+	modifications := []struct {
+		name   string
+		modify func(tree *Tree)
+	}{
+		{"insertion", func(tree *Tree) {
+			tree.Put([]byte{3}, nil)
+		}},
+		{"update", func(tree *Tree) {
+			tree.Put([]byte{2}, []byte{2})
+		}},
+		{"deletion", func(tree *Tree) {
+			tree.Delete([]byte{2})
+		}},
+	}
+
+	for _, m := range modifications {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("Next must panic after %s during iteration", m.name)
+				}
+			}()
+
+			tree := New()
+			tree.Put([]byte{1}, nil)
+			tree.Put([]byte{2}, nil)
+
+			it := tree.Iterator()
+			it.Next()
+
+			m.modify(tree)
+
+			it.Next()
+		}()
+	}
+}
+
+func TestIteratorIgnoresFailedModification(t *testing.T) {
+	tree := New()
+	tree.Put([]byte{1}, nil)
+	tree.Put([]byte{2}, nil)
+
+	it := tree.Iterator()
+	it.Next()
+
+	tree.Delete([]byte{3})
+
+	if key, _ := it.Next(); key[0] != 2 {
+		t.Fatalf("expected key 2, but got %d", key[0])
+	}
+}
+
+func TestCheckedIterator(t *testing.T) {
+	tree := New()
+	for _, c := range iteratorCases {
+		tree.Put([]byte{c.key}, []byte(c.value))
+	}
+
+	expected := tree.Entries()
+	actual := make([]Entry, 0)
+	for it := tree.CheckedIterator(); it.HasNext(); {
+		key, value, err := it.Next()
+		if err != nil {
+			t.Fatalf("failed to iterate: %s", err)
+		}
+		actual = append(actual, Entry{key, value})
+	}
+
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected %v, but got %v", expected, actual)
+	}
+}
+
+func TestCheckedIteratorAfterModification(t *testing.T) {
+	tree := New()
+	tree.Put([]byte{1}, nil)
+	tree.Put([]byte{2}, nil)
+
+	it := tree.CheckedIterator()
+	if _, _, err := it.Next(); err != nil {
+		t.Fatalf("failed to iterate: %s", err)
+	}
+
+	tree.Delete([]byte{3})
+	if key, _, err := it.Next(); err != nil || key[0] != 2 {
+		t.Fatalf("expected key 2 after failed modification, but got %v, %v", key, err)
+	}
+
+	it = tree.CheckedIterator()
+	it.Next()
+	tree.Put([]byte{3}, nil)
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := it.Next(); err != ErrStale {
+			t.Fatalf("expected ErrStale, but got %v", err)
+		}
+	}
+	if !it.HasNext() {
+		t.Fatal("expected the stale iterator not to advance")
+	}
+}
@@ -0,0 +1,129 @@
+package rbytree
+
+import (
+	"bytes"
+	"errors"
+)
+
+// Join concatenates two trees into a new one in O(log n) time, provided
+// that all the keys of the left tree are less than all the keys of
+// the right tree, otherwise it returns an error. Both trees must be
+// either ordinary or multi trees. The nodes are moved to the new tree,
+// so the left and the right trees are empty after a successful join.
+// The new tree does not inherit the observers or the other options.
+func Join(left, right *Tree) (*Tree, error) {
+	if left.multi != right.multi {
+		return nil, errors.New("cannot join ordinary and multi trees")
+	}
+
+	joined := &Tree{multi: left.multi}
+	tombstones := left.tombstones + right.tombstones
+	if left.root == nil || right.root == nil {
+		if left.root == nil {
+			joined.setRoot(right.root)
+		} else {
+			joined.setRoot(left.root)
+		}
+		joined.tombstones = tombstones
+
+		left.setRoot(nil)
+		right.setRoot(nil)
+
+		return joined, nil
+	}
+
+	if bytes.Compare(left.rightmost.key, right.leftmost.key) >= 0 {
+		return nil, errors.New("key ranges of the trees overlap")
+	}
+
+	// the least node of the right tree becomes the pivot that links
+	// the trees
+	pivot := right.leftmost
+	right.unlink(pivot)
+	pivot.color = red
+
+	joined.link(pivot, left.root, right.root)
+
+	left.setRoot(nil)
+	right.setRoot(nil)
+
+	joined.setRoot(joined.root)
+	joined.tombstones = tombstones
+
+	return joined, nil
+}
+
+// link places the detached pivot between the tree rooted at left,
+// whose keys are all less than the pivot key, and the tree rooted at
+// right, whose keys are all greater, and fixes the resulting tree.
+func (t *Tree) link(pivot, left, right *node) {
+	leftHeight, rightHeight := blackHeight(left), blackHeight(right)
+
+	// descend the spine of the higher tree that faces the lower tree
+	// to the black subtree of the same black height as the lower tree,
+	// which is replaced by the pivot with the subtree and the lower tree
+	// as its children
+	var parent *node
+	if leftHeight >= rightHeight {
+		t.root = left
+
+		current, height := left, leftHeight
+		for colorOf(current) == red || height > rightHeight {
+			if current.color == black {
+				height--
+			}
+			parent, current = current, current.right
+		}
+
+		pivot.left, pivot.right = current, right
+		if parent != nil {
+			parent.right = pivot
+		}
+	} else {
+		t.root = right
+
+		current, height := right, rightHeight
+		for colorOf(current) == red || height > leftHeight {
+			if current.color == black {
+				height--
+			}
+			parent, current = current, current.left
+		}
+
+		pivot.left, pivot.right = left, current
+		if parent != nil {
+			parent.left = pivot
+		}
+	}
+
+	if parent == nil {
+		t.root = pivot
+	}
+	pivot.parent = parent
+	if pivot.left != nil {
+		pivot.left.parent = pivot
+	}
+	if pivot.right != nil {
+		pivot.right.parent = pivot
+	}
+
+	pivot.size = sizeOf(pivot.left) + sizeOf(pivot.right) + 1
+	for ancestor := parent; ancestor != nil; ancestor = ancestor.parent {
+		ancestor.size = sizeOf(ancestor.left) + sizeOf(ancestor.right) + 1
+	}
+
+	t.fixAfterInsertion(pivot)
+}
+
+// blackHeight returns the number of black nodes on the path from
+// the node to a leaf, including the node.
+func blackHeight(n *node) int {
+	height := 0
+	for ; n != nil; n = n.left {
+		if n.color == black {
+			height++
+		}
+	}
+
+	return height
+}
@@ -0,0 +1,110 @@
+package rbytree
+
+import (
+	"testing"
+)
+
+func TestJoin(t *testing.T) {
+	for n := 0; n <= 40; n++ {
+		for m := 0; m <= 40; m++ {
+			for _, gap := range []int{0, 5} {
+				left, right := New(), New()
+				for k := 0; k < n; k++ {
+					left.Put([]byte{byte(k)}, []byte{byte(k)})
+				}
+				// ranges are adjacent without the gap, and the right tree is
+				// filled in the reverse order to get a differently shaped tree
+				for k := n + gap + m - 1; k >= n+gap; k-- {
+					right.Put([]byte{byte(k)}, []byte{byte(k)})
+				}
+
+				joined, err := Join(left, right)
+				if err != nil {
+					t.Fatalf("failed to join trees of sizes %d and %d: %s", n, m, err)
+				}
+
+				if err := joined.Validate(); err != nil {
+					t.Fatalf("joined tree of sizes %d and %d is not valid: %s", n, m, err)
+				}
+				if joined.Size() != n+m {
+					t.Fatalf("expected size %d, but got %d", n+m, joined.Size())
+				}
+
+				expected := 0
+				joined.ForEach(func(key, value []byte) {
+					if expected == n {
+						expected += gap
+					}
+					if key[0] != byte(expected) || value[0] != byte(expected) {
+						t.Fatalf("expected key %d, but got %d", expected, key[0])
+					}
+					expected++
+				})
+
+				if left.Size() != 0 || right.Size() != 0 {
+					t.Fatalf("expected the joined trees to be empty, but got sizes %d and %d", left.Size(), right.Size())
+				}
+				if err := left.Validate(); err != nil {
+					t.Fatalf("left tree is not valid: %s", err)
+				}
+				if err := right.Validate(); err != nil {
+					t.Fatalf("right tree is not valid: %s", err)
+				}
+			}
+		}
+	}
+}
+
+func TestJoinForOverlappingRanges(t *testing.T) {
+	cases := []struct {
+		left, right []byte
+	}{
+		{[]byte{1, 5}, []byte{3, 7}},
+		{[]byte{1, 5}, []byte{5, 7}},
+		{[]byte{6, 7}, []byte{1, 2}},
+	}
+
+	for _, c := range cases {
+		left, right := New(), New()
+		for _, key := range c.left {
+			left.Put([]byte{key}, nil)
+		}
+		for _, key := range c.right {
+			right.Put([]byte{key}, nil)
+		}
+
+		if _, err := Join(left, right); err == nil {
+			t.Fatalf("expected error for joining %v and %v", c.left, c.right)
+		}
+		if left.Size() != len(c.left) || right.Size() != len(c.right) {
+			t.Fatal("failed join must not modify the trees")
+		}
+	}
+}
+
+func TestJoinForDifferentKinds(t *testing.T) {
+	if _, err := Join(New(), NewMultiTree()); err == nil {
+		t.Fatal("expected error for joining ordinary and multi trees")
+	}
+}
+
+func TestJoinForMultiTrees(t *testing.T) {
+	left, right := NewMultiTree(), NewMultiTree()
+	left.Put([]byte{1}, []byte{1})
+	right.Put([]byte{2}, []byte{2})
+	right.Put([]byte{2}, []byte{3})
+
+	joined, err := Join(left, right)
+	if err != nil {
+		t.Fatalf("failed to join: %s", err)
+	}
+
+	if values := joined.GetAll([]byte{2}); len(values) != 2 {
+		t.Fatalf("expected 2 values of the pivot key, but got %v", values)
+	}
+
+	joined.Put([]byte{1}, []byte{4})
+	if values := joined.GetAll([]byte{1}); len(values) != 2 {
+		t.Fatalf("expected joined tree to be a multi tree, but got %v", values)
+	}
+}
@@ -0,0 +1,16 @@
+package rbytree
+
+// NewWithValueLoader creates new empty instance of Red-black tree that
+// serves as a sorted index over externally stored values. Put may store
+// only the keys by passing nil values, and the loader is called for
+// the keys without a value held in memory by Get, GetOrDefault, GetCopy,
+// ForEach and the methods built on it: ForEachIndexed,
+// ForEachWithProgress, ForEachWithKeyLen, Entries, ToMap, Stream,
+// MaxBy and MinBy.
+// Get returns the result of the loader as is, so the key is reported as
+// not found if the loader does not find its value.
+// The other methods, like Iterator, StreamContext, the range methods
+// and WriteTo, return the values held in memory only.
+func NewWithValueLoader(loader func(key []byte) ([]byte, bool)) *Tree {
+	return &Tree{loader: loader}
+}
@@ -0,0 +1,145 @@
+package rbytree
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestNewWithValueLoader(t *testing.T) {
+	storage := map[string][]byte{
+		"a": []byte("stored a"),
+		"c": []byte("stored c"),
+	}
+	loads := 0
+	tree := NewWithValueLoader(func(key []byte) ([]byte, bool) {
+		loads++
+		value, ok := storage[string(key)]
+		return value, ok
+	})
+
+	tree.Put([]byte("a"), nil)
+	tree.Put([]byte("b"), nil)
+	tree.Put([]byte("c"), []byte("in memory c"))
+
+	value, ok := tree.Get([]byte("a"))
+	if !ok || !bytes.Equal(value, []byte("stored a")) {
+		t.Fatalf("expected stored a, but got %s, %v", value, ok)
+	}
+
+	if value, ok := tree.Get([]byte("b")); ok || value != nil {
+		t.Fatalf("expected the missing value not to be found, but got %s, %v", value, ok)
+	}
+
+	value, ok = tree.Get([]byte("c"))
+	if !ok || !bytes.Equal(value, []byte("in memory c")) {
+		t.Fatalf("expected in memory c, but got %s, %v", value, ok)
+	}
+
+	if value, ok := tree.Get([]byte("d")); ok || value != nil {
+		t.Fatalf("expected the absent key not to be found, but got %s, %v", value, ok)
+	}
+
+	if loads != 2 {
+		t.Fatalf("expected 2 loads, but got %d", loads)
+	}
+
+	var visited []string
+	tree.ForEach(func(key, value []byte) {
+		visited = append(visited, string(key)+"="+string(value))
+	})
+
+	expected := []string{"a=stored a", "b=", "c=in memory c"}
+	if len(visited) != len(expected) {
+		t.Fatalf("expected %v, but got %v", expected, visited)
+	}
+	for i := range expected {
+		if visited[i] != expected[i] {
+			t.Fatalf("expected %v, but got %v", expected, visited)
+		}
+	}
+
+	if loads != 4 {
+		t.Fatalf("expected 4 loads, but got %d", loads)
+	}
+}
+
+func TestNewWithValueLoaderNotUsedByNew(t *testing.T) {
+	tree := New()
+	tree.Put([]byte("a"), nil)
+
+	value, ok := tree.Get([]byte("a"))
+	if !ok || value != nil {
+		t.Fatalf("expected nil and true, but got %v, %v", value, ok)
+	}
+}
+
+func loaderTree() *Tree {
+	storage := map[string][]byte{
+		"a": []byte("stored a"),
+	}
+	tree := NewWithValueLoader(func(key []byte) ([]byte, bool) {
+		value, ok := storage[string(key)]
+		return value, ok
+	})
+
+	tree.Put([]byte("a"), nil)
+	tree.Put([]byte("b"), []byte("in memory b"))
+
+	return tree
+}
+
+func TestNewWithValueLoaderGetCopy(t *testing.T) {
+	tree := loaderTree()
+
+	value, ok := tree.GetCopy([]byte("a"))
+	if !ok || !bytes.Equal(value, []byte("stored a")) {
+		t.Fatalf("expected stored a, but got %s, %v", value, ok)
+	}
+
+	value, ok = tree.GetCopy([]byte("b"))
+	if !ok || !bytes.Equal(value, []byte("in memory b")) {
+		t.Fatalf("expected in memory b, but got %s, %v", value, ok)
+	}
+}
+
+func TestNewWithValueLoaderForEachIndexed(t *testing.T) {
+	tree := loaderTree()
+
+	var visited []string
+	tree.ForEachIndexed(func(index int, key, value []byte) {
+		visited = append(visited, fmt.Sprintf("%d:%s=%s", index, key, value))
+	})
+
+	expected := []string{"0:a=stored a", "1:b=in memory b"}
+	if !reflect.DeepEqual(visited, expected) {
+		t.Fatalf("expected %v, but got %v", expected, visited)
+	}
+}
+
+func TestNewWithValueLoaderToMap(t *testing.T) {
+	tree := loaderTree()
+
+	m := tree.ToMap()
+	expected := map[string][]byte{
+		"a": []byte("stored a"),
+		"b": []byte("in memory b"),
+	}
+	if !reflect.DeepEqual(m, expected) {
+		t.Fatalf("expected %v, but got %v", expected, m)
+	}
+}
+
+func TestNewWithValueLoaderEntries(t *testing.T) {
+	tree := loaderTree()
+
+	entries := tree.Entries()
+	expected := []Entry{
+		{[]byte("a"), []byte("stored a")},
+		{[]byte("b"), []byte("in memory b")},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Fatalf("expected %v, but got %v", expected, entries)
+	}
+}
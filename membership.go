@@ -0,0 +1,64 @@
+package rbytree
+
+// NewWithMembershipIndex creates new empty instance of Red-black tree
+// that maintains a bitset of all the keys of the given width, which
+// must be 1 or 2 bytes, so that Contains answers for the keys of that
+// width in O(1) time. The bitset takes 32 bytes for the width of 1 and
+// 8 KiB for the width of 2.
+func NewWithMembershipIndex(keyWidth int) *Tree {
+	if keyWidth != 1 && keyWidth != 2 {
+		panic("key width of the membership index must be 1 or 2")
+	}
+
+	return &Tree{members: make([]uint64, (1<<(8*uint(keyWidth)))/64), memberWidth: keyWidth}
+}
+
+// Contains returns true if the key is in the tree.
+func (t *Tree) Contains(key []byte) bool {
+	if t.members != nil && len(key) == t.memberWidth {
+		i := memberIndex(key)
+		return t.members[i/64]&(1<<(i%64)) != 0
+	}
+
+	return t.getNode(key) != nil
+}
+
+// addMember adds the key to the membership index if it is maintained.
+func (t *Tree) addMember(key []byte) {
+	if t.members != nil && len(key) == t.memberWidth {
+		i := memberIndex(key)
+		t.members[i/64] |= 1 << (i % 64)
+	}
+}
+
+// removeMember removes the key from the membership index if it is
+// maintained.
+func (t *Tree) removeMember(key []byte) {
+	if t.members != nil && len(key) == t.memberWidth {
+		i := memberIndex(key)
+		t.members[i/64] &^= 1 << (i % 64)
+	}
+}
+
+// resetMembers rebuilds the membership index if it is maintained.
+func (t *Tree) resetMembers() {
+	if t.members == nil {
+		return
+	}
+
+	for i := range t.members {
+		t.members[i] = 0
+	}
+	t.traverse(func(n *node) {
+		t.addMember(n.key)
+	})
+}
+
+func memberIndex(key []byte) uint {
+	i := uint(0)
+	for _, b := range key {
+		i = i<<8 | uint(b)
+	}
+
+	return i
+}
@@ -0,0 +1,109 @@
+package rbytree
+
+import (
+	"testing"
+)
+
+func TestNewWithMembershipIndex(t *testing.T) {
+	for _, width := range []int{1, 2} {
+		tree := NewWithMembershipIndex(width)
+		reference := make(map[string]bool)
+
+		check := func() {
+			for k := 0; k < 300; k++ {
+				key := []byte{byte(k >> 8), byte(k)}[2-width:]
+				if tree.Contains(key) != reference[string(key)] {
+					t.Fatalf("width %d: expected Contains(%v) to be %v", width, key, reference[string(key)])
+				}
+			}
+		}
+
+		for k := 0; k < 300; k += 3 {
+			key := []byte{byte(k >> 8), byte(k)}[2-width:]
+			tree.Put(key, nil)
+			reference[string(key)] = true
+		}
+		check()
+
+		for k := 0; k < 300; k += 6 {
+			key := []byte{byte(k >> 8), byte(k)}[2-width:]
+			tree.Delete(key)
+			delete(reference, string(key))
+		}
+		check()
+
+		tree.Rebuild()
+		check()
+
+		tree.Retain(nil, []byte{1})
+		for key := range reference {
+			if key >= string([]byte{1}) {
+				delete(reference, key)
+			}
+		}
+		check()
+
+		other := New()
+		other.Put([]byte{7}, nil)
+		tree.Swap(other)
+		reference = map[string]bool{string([]byte{7}): width == 1}
+		check()
+	}
+}
+
+func TestContainsForOtherWidths(t *testing.T) {
+	tree := NewWithMembershipIndex(1)
+	tree.Put([]byte{1, 2, 3}, nil)
+	tree.Put(nil, nil)
+
+	if !tree.Contains([]byte{1, 2, 3}) || !tree.Contains(nil) {
+		t.Fatal("expected the keys of other widths to be found")
+	}
+	if tree.Contains([]byte{1, 2}) || tree.Contains([]byte{1}) {
+		t.Fatal("expected absent keys not to be found")
+	}
+
+	plain := New()
+	plain.Put([]byte{1}, nil)
+	if !plain.Contains([]byte{1}) || plain.Contains([]byte{2}) {
+		t.Fatal("expected Contains to work without the index")
+	}
+}
+
+func TestNewWithMembershipIndexPanicsForInvalidWidth(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatal("expected panic for the key width of 3")
+		}
+	}()
+
+	NewWithMembershipIndex(3)
+}
+
+func BenchmarkTreeContains(b *testing.B) {
+	benchmarkContains(b, New())
+}
+
+func BenchmarkTreeContainsWithMembershipIndex(b *testing.B) {
+	benchmarkContains(b, NewWithMembershipIndex(2))
+}
+
+func benchmarkContains(b *testing.B, tree *Tree) {
+	keys := make([][]byte, 1<<16)
+	for k := range keys {
+		keys[k] = []byte{byte(k >> 8), byte(k)}
+		if k%2 == 0 {
+			tree.Put(keys[k], nil)
+		}
+	}
+
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		for _, key := range keys {
+			BenchmarkContains = tree.Contains(key)
+		}
+	}
+}
+
+var BenchmarkContains bool
@@ -0,0 +1,88 @@
+package rbytree
+
+// NewWithInsertionOrder creates new empty instance of Red-black tree that
+// also links its nodes in the order of the insertion of their keys, so
+// that ForEachInsertionOrder can traverse them in that order. Overriding
+// the value of an existing key keeps its position. It takes two more
+// pointers per node and a little more work on every insertion and
+// deletion.
+func NewWithInsertionOrder() *Tree {
+	return &Tree{ordered: true}
+}
+
+// ForEachInsertionOrder traverses tree in the order of the insertion of
+// the keys, from the oldest to the newest. The order is tracked only by
+// the trees created with NewWithInsertionOrder, for the other trees
+// the action is not called. Keys must not be modified.
+func (t *Tree) ForEachInsertionOrder(action func(key, value []byte)) {
+	for current := t.oldest; current != nil; current = current.newer {
+		action(current.key, current.value)
+
+		for _, duplicate := range current.duplicates {
+			action(current.key, duplicate)
+		}
+	}
+}
+
+// appendOrder links the node as the newest one if the order is tracked.
+func (t *Tree) appendOrder(n *node) {
+	if !t.ordered {
+		return
+	}
+
+	n.older, n.newer = t.newest, nil
+	if t.newest == nil {
+		t.oldest = n
+	} else {
+		t.newest.newer = n
+	}
+	t.newest = n
+}
+
+// removeOrder unlinks the node from the insertion order if it is tracked.
+func (t *Tree) removeOrder(n *node) {
+	if !t.ordered {
+		return
+	}
+
+	if n.older == nil {
+		t.oldest = n.newer
+	} else {
+		n.older.newer = n.newer
+	}
+
+	if n.newer == nil {
+		t.newest = n.older
+	} else {
+		n.newer.older = n.older
+	}
+
+	n.older, n.newer = nil, nil
+}
+
+// relinkOrder links the rebuilt nodes in the insertion order of
+// the nodes they replace, starting from the oldest, if the order is
+// tracked. The nodes missing from the rebuilt tree are skipped.
+func (t *Tree) relinkOrder(oldest *node, nodes, rebuilt []*node) {
+	if !t.ordered {
+		return
+	}
+
+	replacements := make(map[*node]*node, len(nodes))
+	for i, n := range nodes {
+		replacements[n] = rebuilt[i]
+	}
+
+	for current := oldest; current != nil; current = current.newer {
+		if replacement, ok := replacements[current]; ok {
+			t.appendOrder(replacement)
+		}
+	}
+}
+
+// resetOrder links the nodes in ascending key order if the order is
+// tracked, since the original insertion order is unknown.
+func (t *Tree) resetOrder() {
+	t.oldest, t.newest = nil, nil
+	t.traverse(t.appendOrder)
+}
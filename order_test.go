@@ -0,0 +1,99 @@
+package rbytree
+
+import (
+	"bytes"
+	"testing"
+)
+
+func insertionOrder(tree *Tree) []byte {
+	keys := make([]byte, 0)
+	tree.ForEachInsertionOrder(func(key, value []byte) {
+		keys = append(keys, key[0])
+	})
+
+	return keys
+}
+
+func expectInsertionOrder(t *testing.T, tree *Tree, expected ...byte) {
+	if keys := insertionOrder(tree); !bytes.Equal(keys, expected) {
+		t.Fatalf("expected insertion order %v, but got %v", expected, keys)
+	}
+}
+
+func TestNewWithInsertionOrder(t *testing.T) {
+	tree := NewWithInsertionOrder()
+	expectInsertionOrder(t, tree)
+
+	for _, key := range []byte{5, 1, 9, 3, 7} {
+		tree.Put([]byte{key}, []byte{key})
+	}
+	expectInsertionOrder(t, tree, 5, 1, 9, 3, 7)
+
+	tree.Put([]byte{1}, []byte{10})
+	expectInsertionOrder(t, tree, 5, 1, 9, 3, 7)
+
+	tree.Delete([]byte{5})
+	tree.Delete([]byte{3})
+	expectInsertionOrder(t, tree, 1, 9, 7)
+
+	tree.Put([]byte{5}, nil)
+	expectInsertionOrder(t, tree, 1, 9, 7, 5)
+
+	tree.Rebuild()
+	expectInsertionOrder(t, tree, 1, 9, 7, 5)
+
+	tree.Retain([]byte{2}, nil)
+	expectInsertionOrder(t, tree, 9, 7, 5)
+
+	tree.PutBatch(func(put func(key, value []byte)) {
+		put([]byte{4}, nil)
+		put([]byte{9}, nil)
+		put([]byte{2}, nil)
+	})
+	expectInsertionOrder(t, tree, 9, 7, 5, 4, 2)
+
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("tree is not valid: %s", err)
+	}
+
+	for _, key := range []byte{9, 7, 5, 4, 2} {
+		tree.Delete([]byte{key})
+	}
+	expectInsertionOrder(t, tree)
+}
+
+func TestNewWithInsertionOrderAndTombstones(t *testing.T) {
+	tree := NewWithInsertionOrder()
+	tree.softDelete = true
+
+	tree.Put([]byte{1}, nil)
+	tree.Put([]byte{2}, nil)
+	tree.Delete([]byte{1})
+	expectInsertionOrder(t, tree, 2)
+
+	tree.Put([]byte{1}, nil)
+	expectInsertionOrder(t, tree, 2, 1)
+
+	tree.Delete([]byte{2})
+	tree.Purge()
+	expectInsertionOrder(t, tree, 1)
+}
+
+func TestForEachInsertionOrderWithoutTracking(t *testing.T) {
+	tree := New()
+	tree.Put([]byte{1}, nil)
+
+	expectInsertionOrder(t, tree)
+}
+
+func TestSwapWithInsertionOrder(t *testing.T) {
+	ordered, plain := NewWithInsertionOrder(), New()
+	ordered.Put([]byte{2}, nil)
+	ordered.Put([]byte{1}, nil)
+	plain.Put([]byte{4}, nil)
+	plain.Put([]byte{3}, nil)
+
+	ordered.Swap(plain)
+	expectInsertionOrder(t, ordered, 3, 4)
+	expectInsertionOrder(t, plain)
+}
@@ -0,0 +1,110 @@
+package rbytree
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// OperationKind describes the kind of the operation applied
+// by CheckAgainstReference.
+type OperationKind byte
+
+const (
+	// OperationPut puts the key with the value.
+	OperationPut OperationKind = iota
+	// OperationGet gets the value of the key.
+	OperationGet
+	// OperationDelete deletes the key.
+	OperationDelete
+)
+
+// Operation describes the operation applied by CheckAgainstReference.
+// Value is used only by OperationPut.
+type Operation struct {
+	Kind  OperationKind
+	Key   []byte
+	Value []byte
+}
+
+// CheckAgainstReference applies the operations to a new tree and to
+// a reference map and returns an error describing the first divergence
+// between them, including invariant violations of the tree, or nil.
+// It is meant to be used as an oracle by fuzz tests:
+//
+//	func FuzzTree(f *testing.F) {
+//		f.Fuzz(func(t *testing.T, data []byte) {
+//			if err := rbytree.CheckAgainstReference(decode(data)); err != nil {
+//				t.Fatal(err)
+//			}
+//		})
+//	}
+func CheckAgainstReference(ops []Operation) error {
+	tree := New()
+	reference := make(map[string][]byte)
+
+	for i, op := range ops {
+		expected, expectedOk := reference[string(op.Key)]
+
+		switch op.Kind {
+		case OperationPut:
+			prev, exists := tree.Put(op.Key, op.Value)
+			if exists != expectedOk || !bytes.Equal(prev, expected) {
+				return fmt.Errorf("operation %d: Put(%v) returned %v, %v, but expected %v, %v", i, op.Key, prev, exists, expected, expectedOk)
+			}
+
+			reference[string(op.Key)] = op.Value
+		case OperationGet:
+			value, ok := tree.Get(op.Key)
+			if ok != expectedOk || !bytes.Equal(value, expected) {
+				return fmt.Errorf("operation %d: Get(%v) returned %v, %v, but expected %v, %v", i, op.Key, value, ok, expected, expectedOk)
+			}
+		case OperationDelete:
+			if deleted := tree.Delete(op.Key); deleted != expectedOk {
+				return fmt.Errorf("operation %d: Delete(%v) returned %v, but expected %v", i, op.Key, deleted, expectedOk)
+			}
+
+			delete(reference, string(op.Key))
+		default:
+			return fmt.Errorf("operation %d: unknown kind %d", i, op.Kind)
+		}
+
+		if err := tree.Validate(); err != nil {
+			return fmt.Errorf("operation %d: tree is not valid: %s", i, err)
+		}
+
+		if err := compareWithReference(tree, reference); err != nil {
+			return fmt.Errorf("operation %d: %s", i, err)
+		}
+	}
+
+	return nil
+}
+
+// compareWithReference compares the entries of the tree in ascending key
+// order with the entries of the reference map sorted by key.
+func compareWithReference(tree *Tree, reference map[string][]byte) error {
+	if tree.Size() != len(reference) {
+		return fmt.Errorf("tree size is %d, but expected %d", tree.Size(), len(reference))
+	}
+
+	keys := make([]string, 0, len(reference))
+	for key := range reference {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	i := 0
+	for it := tree.Iterator(); it.HasNext(); i++ {
+		key, value := it.Next()
+		if string(key) != keys[i] {
+			return fmt.Errorf("key at position %d is %v, but expected %v", i, key, []byte(keys[i]))
+		}
+
+		if !bytes.Equal(value, reference[keys[i]]) {
+			return fmt.Errorf("value of key %v is %v, but expected %v", key, value, reference[keys[i]])
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,49 @@
+package rbytree
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestCheckAgainstReference(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+
+	ops := make([]Operation, 0)
+	for i := 0; i < 2048; i++ {
+		key := []byte{byte(random.Intn(64))}
+		ops = append(ops, Operation{OperationKind(random.Intn(3)), key, []byte{byte(i)}})
+	}
+
+	if err := CheckAgainstReference(ops); err != nil {
+		t.Fatalf("tree diverged from the reference: %s", err)
+	}
+}
+
+func TestCheckAgainstReferenceForNoOperations(t *testing.T) {
+	if err := CheckAgainstReference(nil); err != nil {
+		t.Fatalf("expected no error, but got: %s", err)
+	}
+}
+
+func TestCheckAgainstReferenceForUnknownOperation(t *testing.T) {
+	if err := CheckAgainstReference([]Operation{{Kind: 42}}); err == nil {
+		t.Fatal("expected error for the unknown operation")
+	}
+}
+
+func TestCompareWithReferenceDetectsDivergence(t *testing.T) {
+	tree := New()
+	tree.Put([]byte{1}, []byte{1})
+
+	cases := []map[string][]byte{
+		{},
+		{string([]byte{2}): {1}},
+		{string([]byte{1}): {2}},
+	}
+
+	for _, reference := range cases {
+		if err := compareWithReference(tree, reference); err == nil {
+			t.Fatalf("expected divergence from %v to be detected", reference)
+		}
+	}
+}
@@ -0,0 +1,416 @@
+package rbytree
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"io"
+)
+
+// errLengthOverflow is returned when a record length read from the stream
+// does not fit into int.
+var errLengthOverflow = errors.New("record length overflows int")
+
+// maxPreallocatedRecord is the length of the longest record that is
+// allocated at once before reading it.
+const maxPreallocatedRecord = 1 << 16
+
+// ErrBadMagic is returned by ReadFrom when the stream does not start
+// with the magic number written by WriteTo.
+var ErrBadMagic = errors.New("bad magic number")
+
+// ErrUnsupportedVersion is returned by ReadFrom when the stream is
+// written in a format version it does not support.
+var ErrUnsupportedVersion = errors.New("unsupported format version")
+
+// magic starts the header written by WriteTo.
+var magic = [4]byte{'r', 'b', 'y', 't'}
+
+// formatVersion is the version of the format written by WriteTo.
+const formatVersion = 1
+
+// maxHeaderLength is the length of the longest header.
+const maxHeaderLength = len(magic) + 1 + binary.MaxVarintLen64
+
+// maxPreallocated limits the number of nodes ReadFrom preallocates
+// for the entry count read from the header.
+const maxPreallocated = 1 << 16
+
+// WriteTo writes the header followed by all the entries of the tree
+// in ascending key order to the writer in the format read by ReadFrom
+// and returns the number of written bytes. The header consists of
+// the magic number, the format version byte and the uvarint number
+// of the entries, and the entries are in the format read by LoadStream.
+// Entries are streamed directly from the tree without building
+// an intermediate copy of them in memory.
+func (t *Tree) WriteTo(w io.Writer) (int64, error) {
+	var buf [maxHeaderLength]byte
+	written, err := writeHeader(w, buf[:], uint64(t.entryCount()))
+	if err != nil {
+		return written, err
+	}
+
+	n, err := t.writeEntries(w, buf[:])
+
+	return written + n, err
+}
+
+// writeHeader writes the magic number, the format version and
+// the number of the entries. The buf must hold maxHeaderLength bytes.
+func writeHeader(w io.Writer, buf []byte, count uint64) (int64, error) {
+	copy(buf, magic[:])
+	buf[len(magic)] = formatVersion
+	n := len(magic) + 1
+	n += binary.PutUvarint(buf[n:], count)
+
+	written, err := w.Write(buf[:n])
+
+	return int64(written), err
+}
+
+// entryCount returns the number of the entries written by WriteTo,
+// counting all the values of the keys of a multi tree.
+func (t *Tree) entryCount() int {
+	if !t.multi {
+		return t.Size()
+	}
+
+	count := 0
+	for current := live(t.leftmost); current != nil; current = live(successor(current)) {
+		count += 1 + len(current.duplicates)
+	}
+
+	return count
+}
+
+// writeEntries writes all the entries of the tree in ascending key order.
+func (t *Tree) writeEntries(w io.Writer, buf []byte) (int64, error) {
+	if t.root == nil {
+		return 0, nil
+	}
+
+	var written int64
+	for current := live(minimum(t.root)); current != nil; current = live(successor(current)) {
+		n, err := writeNode(w, buf, current)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// WriteToReverse writes the header and all the entries of the tree
+// like WriteTo, but in descending key order. The values of a key of
+// a multi tree are still written in insertion order.
+func (t *Tree) WriteToReverse(w io.Writer) (int64, error) {
+	var buf [maxHeaderLength]byte
+	written, err := writeHeader(w, buf[:], uint64(t.entryCount()))
+	if err != nil {
+		return written, err
+	}
+
+	for current := t.rightmost; current != nil; current = predecessor(current) {
+		if current.deleted {
+			continue
+		}
+
+		n, err := writeNode(w, buf[:], current)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// writeNode writes the entries of all the values of the node.
+func writeNode(w io.Writer, buf []byte, n *node) (int64, error) {
+	written, err := writeEntry(w, buf, n.key, n.value)
+	if err != nil {
+		return written, err
+	}
+
+	for _, duplicate := range n.duplicates {
+		m, err := writeEntry(w, buf, n.key, duplicate)
+		written += m
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// Hash returns the 64-bit FNV-1a hash of the entries of the tree written
+// in ascending key order in the format of WriteTo, without the header,
+// so the trees holding the same entries have the same hash regardless
+// of their structure.
+func (t *Tree) Hash() uint64 {
+	h := fnv.New64a()
+	var buf [binary.MaxVarintLen64]byte
+	// writing to the hash never fails
+	t.writeEntries(h, buf[:])
+
+	return h.Sum64()
+}
+
+// Reader returns a reader that produces the header and the entries of
+// the tree written by WriteTo as they are read, without buffering
+// the whole serialization in memory. The entries are written by
+// a separate goroutine, so the tree must not be modified until
+// the reader is read to the end or closed. Close stops the goroutine.
+func (t *Tree) Reader() io.ReadCloser {
+	r, w := io.Pipe()
+	go func() {
+		_, err := t.WriteTo(w)
+		w.CloseWithError(err)
+	}()
+
+	return r
+}
+
+// RangeReader returns a reader that produces the header and the entries
+// with keys in the range [lo, hi) in the format written by WriteTo,
+// like Reader. The range is traversed twice, first to count the entries.
+// Nil lo or hi means that the range is unbounded on that side.
+// The tree must not be modified until the reader is read to the end
+// or closed. Close stops the goroutine writing the entries.
+func (t *Tree) RangeReader(lo, hi []byte) io.ReadCloser {
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(t.writeRange(w, lo, hi))
+	}()
+
+	return r
+}
+
+// writeRange writes the header and the entries with keys in the range [lo, hi).
+func (t *Tree) writeRange(w io.Writer, lo, hi []byte) error {
+	// both passes walk between the same nodes,
+	// so the count in the header matches the written entries
+	first, end := t.rangeBounds(lo, hi)
+
+	count := 0
+	walkNodes(first, end, func(n *node) bool {
+		count += 1 + len(n.duplicates)
+		return true
+	})
+
+	var buf [maxHeaderLength]byte
+	if _, err := writeHeader(w, buf[:], uint64(count)); err != nil {
+		return err
+	}
+
+	var err error
+	walkNodes(first, end, func(n *node) bool {
+		_, err = writeNode(w, buf[:], n)
+		return err == nil
+	})
+
+	return err
+}
+
+func writeEntry(w io.Writer, buf []byte, key, value []byte) (int64, error) {
+	n, err := writeRecord(w, buf, key)
+	if err != nil {
+		return n, err
+	}
+
+	m, err := writeRecord(w, buf, value)
+
+	return n + m, err
+}
+
+// writeRecord writes the uvarint length of the record followed by the record.
+func writeRecord(w io.Writer, buf []byte, record []byte) (int64, error) {
+	n, err := w.Write(buf[:binary.PutUvarint(buf, uint64(len(record)))])
+	if err != nil {
+		return int64(n), err
+	}
+
+	m, err := w.Write(record)
+
+	return int64(n + m), err
+}
+
+// ReadFrom reads the header and the entries written by WriteTo from
+// the reader and puts them into the tree, returning the number of read
+// bytes. It returns ErrBadMagic or ErrUnsupportedVersion before reading
+// any entries if the header does not match, and io.ErrUnexpectedEOF
+// if the stream ends before all the entries counted in the header.
+// The entry count is used to preallocate the nodes.
+// It does not read past the last entry, so the reader can hold more
+// data after it, but unless the reader is an io.ByteReader, the lengths
+// are read byte by byte, so wrap a slow reader with bufio.Reader.
+func (t *Tree) ReadFrom(r io.Reader) (int64, error) {
+	cr := &countingReader{r: r}
+	if br, ok := r.(io.ByteReader); ok {
+		cr.br = br
+	}
+
+	var header [len(magic) + 1]byte
+	if _, err := io.ReadFull(cr, header[:]); err != nil {
+		if err == io.EOF {
+			return cr.read, io.ErrUnexpectedEOF
+		}
+
+		return cr.read, err
+	}
+	if !bytes.Equal(header[:len(magic)], magic[:]) {
+		return cr.read, ErrBadMagic
+	}
+	if header[len(magic)] != formatVersion {
+		return cr.read, ErrUnsupportedVersion
+	}
+
+	count, err := binary.ReadUvarint(cr)
+	if err != nil {
+		if err == io.EOF {
+			return cr.read, io.ErrUnexpectedEOF
+		}
+
+		return cr.read, err
+	}
+
+	if len(t.pool) == 0 {
+		preallocated := count
+		if preallocated > maxPreallocated {
+			preallocated = maxPreallocated
+		}
+		t.pool = make([]node, int(preallocated))
+	}
+
+	for ; count > 0; count-- {
+		key, err := readRecord(cr, cr)
+		if err == io.EOF {
+			return cr.read, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return cr.read, err
+		}
+
+		value, err := readRecord(cr, cr)
+		if err == io.EOF {
+			return cr.read, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return cr.read, err
+		}
+
+		t.Put(key, value)
+	}
+
+	return cr.read, nil
+}
+
+// countingReader counts the bytes read through it. It reads a single
+// byte from the reader if it is not an io.ByteReader, so it never reads
+// ahead like bufio.Reader does.
+type countingReader struct {
+	r    io.Reader
+	br   io.ByteReader
+	read int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.read += int64(n)
+
+	return n, err
+}
+
+func (r *countingReader) ReadByte() (byte, error) {
+	if r.br == nil {
+		var b [1]byte
+		_, err := io.ReadFull(r, b[:])
+
+		return b[0], err
+	}
+
+	b, err := r.br.ReadByte()
+	if err == nil {
+		r.read++
+	}
+
+	return b, err
+}
+
+// LoadStream reads the key/value pairs from the reader one by one and puts
+// them into a new tree. Each pair is encoded as the uvarint length of
+// the key, the key, the uvarint length of the value and the value.
+// The pairs might come in any order, later values override earlier ones.
+// It stops at EOF between the pairs and returns io.ErrUnexpectedEOF
+// if the stream ends in the middle of a pair.
+func LoadStream(r io.Reader) (*Tree, error) {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		buffered := bufio.NewReader(r)
+		br, r = buffered, buffered
+	}
+
+	tree := New()
+	for {
+		key, err := readRecord(r, br)
+		if err == io.EOF {
+			return tree, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := readRecord(r, br)
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		tree.Put(key, value)
+	}
+}
+
+// readRecord reads the uvarint length followed by that many bytes.
+// It returns io.EOF only if the stream ends before the length.
+// The records longer than maxPreallocatedRecord are read into a growing
+// buffer, so that a corrupted length does not allocate the memory
+// for the bytes the stream does not have.
+func readRecord(r io.Reader, br io.ByteReader) ([]byte, error) {
+	length, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+
+	if length > uint64(^uint(0)>>1) {
+		return nil, errLengthOverflow
+	}
+
+	if length > maxPreallocatedRecord {
+		var record bytes.Buffer
+		if _, err := io.CopyN(&record, r, int64(length)); err != nil {
+			if err == io.EOF {
+				return nil, io.ErrUnexpectedEOF
+			}
+
+			return nil, err
+		}
+
+		return record.Bytes(), nil
+	}
+
+	record := make([]byte, int(length))
+	if _, err := io.ReadFull(r, record); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+
+		return nil, err
+	}
+
+	return record, nil
+}
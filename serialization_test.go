@@ -0,0 +1,498 @@
+package rbytree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+// countingWriter counts the written bytes and discards them.
+type countingWriter struct {
+	written int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.written += int64(len(p))
+
+	return len(p), nil
+}
+
+// failingWriter fails after accepting the given number of writes.
+type failingWriter struct {
+	writes int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.writes == 0 {
+		return 0, errors.New("write failed")
+	}
+	w.writes--
+
+	return len(p), nil
+}
+
+func appendRecord(b []byte, record []byte) []byte {
+	var length [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(length[:], uint64(len(record)))
+
+	return append(append(b, length[:n]...), record...)
+}
+
+func TestLoadStream(t *testing.T) {
+	stream := make([]byte, 0)
+	for _, c := range treeCases {
+		stream = appendRecord(stream, []byte{c.key})
+		stream = appendRecord(stream, []byte(c.value))
+	}
+
+	tree, err := LoadStream(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatalf("failed to load stream: %s", err)
+	}
+
+	if tree.Size() != len(treeCases) {
+		t.Fatalf("expected size %d, but got %d", len(treeCases), tree.Size())
+	}
+
+	for _, c := range treeCases {
+		value, ok := tree.Get([]byte{c.key})
+		if !ok || string(value) != c.value {
+			t.Fatalf("expected value %s for key %d, but got %s, %v", c.value, c.key, value, ok)
+		}
+	}
+
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("loaded tree is not valid: %s", err)
+	}
+}
+
+func TestLoadStreamForEmptyStream(t *testing.T) {
+	tree, err := LoadStream(bytes.NewReader(nil))
+	if err != nil {
+		t.Fatalf("failed to load empty stream: %s", err)
+	}
+
+	if tree.Size() != 0 {
+		t.Fatalf("expected empty tree, but got size %d", tree.Size())
+	}
+}
+
+func TestLoadStreamForTruncatedStream(t *testing.T) {
+	stream := appendRecord(nil, []byte("key"))
+	stream = appendRecord(stream, []byte("value"))
+
+	for i := 1; i < len(stream); i++ {
+		_, err := LoadStream(bytes.NewReader(stream[:i]))
+		if err != io.ErrUnexpectedEOF {
+			t.Fatalf("expected io.ErrUnexpectedEOF for the stream truncated at %d, but got %v", i, err)
+		}
+	}
+}
+
+func TestLoadStreamForCorruptedLength(t *testing.T) {
+	for _, length := range []uint64{maxPreallocatedRecord + 1, 1 << 40, 1 << 50, 1<<63 - 1} {
+		var buf [binary.MaxVarintLen64]byte
+		stream := append(buf[:binary.PutUvarint(buf[:], length)], "key"...)
+
+		if _, err := LoadStream(bytes.NewReader(stream)); err != io.ErrUnexpectedEOF {
+			t.Fatalf("expected io.ErrUnexpectedEOF for length %d, but got %v", length, err)
+		}
+
+		header := []byte{'r', 'b', 'y', 't', formatVersion, 1}
+		if _, err := New().ReadFrom(bytes.NewReader(append(header, stream...))); err != io.ErrUnexpectedEOF {
+			t.Fatalf("expected io.ErrUnexpectedEOF for length %d, but got %v", length, err)
+		}
+	}
+}
+
+func TestLoadStreamForLongRecord(t *testing.T) {
+	value := bytes.Repeat([]byte{7}, 3*maxPreallocatedRecord)
+	stream := appendRecord(appendRecord(nil, []byte("key")), value)
+
+	tree, err := LoadStream(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatalf("failed to load stream: %s", err)
+	}
+	if loaded, ok := tree.Get([]byte("key")); !ok || !bytes.Equal(loaded, value) {
+		t.Fatalf("expected value of %d bytes, but got %d bytes", len(value), len(loaded))
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	tree := New()
+	for _, c := range treeCases {
+		tree.Put([]byte{c.key}, []byte(c.value))
+	}
+
+	var buf bytes.Buffer
+	written, err := tree.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("failed to write tree: %s", err)
+	}
+	if written != int64(buf.Len()) {
+		t.Fatalf("expected %d written bytes, but got %d", buf.Len(), written)
+	}
+
+	loaded := New()
+	read, err := loaded.ReadFrom(&buf)
+	if err != nil {
+		t.Fatalf("failed to read written tree: %s", err)
+	}
+	if read != written {
+		t.Fatalf("expected %d read bytes, but got %d", written, read)
+	}
+
+	if !equalEntries(tree, loaded) {
+		t.Fatal("loaded tree differs from the written one")
+	}
+}
+
+func TestWriteToForEmptyTree(t *testing.T) {
+	var buf bytes.Buffer
+	written, err := New().WriteTo(&buf)
+	if err != nil || written != int64(buf.Len()) {
+		t.Fatalf("failed to write empty tree: %d, %v", written, err)
+	}
+
+	header := []byte{'r', 'b', 'y', 't', formatVersion, 0}
+	if !bytes.Equal(buf.Bytes(), header) {
+		t.Fatalf("expected only header %v, but got %v", header, buf.Bytes())
+	}
+
+	loaded := New()
+	if _, err := loaded.ReadFrom(&buf); err != nil || loaded.Size() != 0 {
+		t.Fatalf("expected empty tree, but got size %d and error %v", loaded.Size(), err)
+	}
+}
+
+func TestWriteToForMultiTree(t *testing.T) {
+	tree := NewMultiTree()
+	tree.Put([]byte{1}, []byte{1})
+	tree.Put([]byte{1}, []byte{2})
+	tree.Put([]byte{2}, []byte{3})
+
+	var buf bytes.Buffer
+	if _, err := tree.WriteTo(&buf); err != nil {
+		t.Fatalf("failed to write tree: %s", err)
+	}
+
+	loaded := NewMultiTree()
+	if _, err := loaded.ReadFrom(&buf); err != nil {
+		t.Fatalf("failed to read written tree: %s", err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("expected all the entries to be read, but %d bytes left", buf.Len())
+	}
+
+	if !equalEntries(tree, loaded) {
+		t.Fatalf("expected %v, but got %v", tree.Entries(), loaded.Entries())
+	}
+}
+
+func TestReadFromLeavesTrailingData(t *testing.T) {
+	tree := New()
+	for _, c := range treeCases {
+		tree.Put([]byte{c.key}, []byte(c.value))
+	}
+
+	var buf bytes.Buffer
+	if _, err := tree.WriteTo(&buf); err != nil {
+		t.Fatalf("failed to write tree: %s", err)
+	}
+	buf.WriteString("trailer")
+
+	// hides io.ByteReader of bytes.Buffer
+	r := struct{ io.Reader }{&buf}
+
+	loaded := New()
+	if _, err := loaded.ReadFrom(r); err != nil {
+		t.Fatalf("failed to read written tree: %s", err)
+	}
+	if !equalEntries(tree, loaded) {
+		t.Fatal("loaded tree differs from the written one")
+	}
+
+	if rest, _ := ioutil.ReadAll(r); string(rest) != "trailer" {
+		t.Fatalf("expected trailer to be left in the reader, but got %q", rest)
+	}
+}
+
+func TestWriteHeaderForLargeCount(t *testing.T) {
+	var buf [maxHeaderLength]byte
+	var header bytes.Buffer
+	if _, err := writeHeader(&header, buf[:], 1<<62); err != nil {
+		t.Fatalf("failed to write header: %s", err)
+	}
+
+	count, err := binary.ReadUvarint(bytes.NewReader(header.Bytes()[len(magic)+1:]))
+	if err != nil || count != 1<<62 {
+		t.Fatalf("expected count %d, but got %d, %v", uint64(1<<62), count, err)
+	}
+}
+
+func TestReadFromFails(t *testing.T) {
+	tree := New()
+	tree.Put([]byte("key"), []byte("value"))
+
+	var buf bytes.Buffer
+	if _, err := tree.WriteTo(&buf); err != nil {
+		t.Fatalf("failed to write tree: %s", err)
+	}
+	stream := buf.Bytes()
+
+	badMagic := append([]byte{'x'}, stream[1:]...)
+	if _, err := New().ReadFrom(bytes.NewReader(badMagic)); err != ErrBadMagic {
+		t.Fatalf("expected ErrBadMagic, but got %v", err)
+	}
+
+	badVersion := copyBytes(stream)
+	badVersion[len(magic)] = formatVersion + 1
+	if _, err := New().ReadFrom(bytes.NewReader(badVersion)); err != ErrUnsupportedVersion {
+		t.Fatalf("expected ErrUnsupportedVersion, but got %v", err)
+	}
+
+	for i := 0; i < len(stream); i++ {
+		_, err := New().ReadFrom(bytes.NewReader(stream[:i]))
+		if err != io.ErrUnexpectedEOF {
+			t.Fatalf("expected io.ErrUnexpectedEOF for the stream truncated at %d, but got %v", i, err)
+		}
+	}
+}
+
+func TestWriteToFails(t *testing.T) {
+	tree := New()
+	for _, c := range treeCases {
+		tree.Put([]byte{c.key}, []byte(c.value))
+	}
+
+	for writes := 0; writes < 4; writes++ {
+		if _, err := tree.WriteTo(&failingWriter{writes}); err == nil {
+			t.Fatalf("expected error after %d writes", writes)
+		}
+	}
+}
+
+func TestWriteToReverse(t *testing.T) {
+	tree := New()
+	for _, c := range treeCases {
+		tree.Put([]byte{c.key}, []byte(c.value))
+	}
+
+	var buf bytes.Buffer
+	written, err := tree.WriteToReverse(&buf)
+	if err != nil {
+		t.Fatalf("failed to write tree: %s", err)
+	}
+	if written != int64(buf.Len()) {
+		t.Fatalf("expected %d written bytes, but got %d", buf.Len(), written)
+	}
+
+	var expected []byte
+	expected = append(expected, 'r', 'b', 'y', 't', formatVersion, byte(tree.Size()))
+	for i := len(tree.Entries()) - 1; i >= 0; i-- {
+		entry := tree.Entries()[i]
+		expected = appendRecord(appendRecord(expected, entry.Key), entry.Value)
+	}
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Fatal("expected entries in descending key order")
+	}
+
+	loaded := New()
+	if _, err := loaded.ReadFrom(&buf); err != nil {
+		t.Fatalf("failed to read written tree: %s", err)
+	}
+	if !equalEntries(tree, loaded) {
+		t.Fatal("loaded tree differs from the written one")
+	}
+
+	if written, err := New().WriteToReverse(&buf); err != nil || written != 6 {
+		t.Fatalf("expected only header to be written, but got %d, %v", written, err)
+	}
+}
+
+func TestWriteToReverseFails(t *testing.T) {
+	tree := New()
+	for _, c := range treeCases {
+		tree.Put([]byte{c.key}, []byte(c.value))
+	}
+
+	for writes := 0; writes < 4; writes++ {
+		if _, err := tree.WriteToReverse(&failingWriter{writes}); err == nil {
+			t.Fatalf("expected error after %d writes", writes)
+		}
+	}
+}
+
+func TestWriteToStreams(t *testing.T) {
+	allocs := func(size int) float64 {
+		tree := New()
+		for k := 0; k < size; k++ {
+			key := []byte{byte(k >> 8), byte(k)}
+			tree.Put(key, key)
+		}
+
+		w := &countingWriter{}
+
+		return testing.AllocsPerRun(10, func() {
+			tree.WriteTo(w)
+		})
+	}
+
+	small, large := allocs(16), allocs(16384)
+	if large > small {
+		t.Fatalf("allocations must not grow with the tree size: %v for small tree, %v for large tree", small, large)
+	}
+}
+
+func TestHash(t *testing.T) {
+	a, b := New(), New()
+	if a.Hash() != b.Hash() {
+		t.Fatal("expected the same hash for empty trees")
+	}
+
+	for k := 0; k < 100; k++ {
+		a.Put([]byte{byte(k)}, []byte{byte(k)})
+	}
+	for k := 99; k >= 0; k-- {
+		b.Put([]byte{byte(k)}, []byte{byte(k)})
+	}
+	if shape(a.root) == shape(b.root) {
+		t.Fatal("expected trees of different shapes")
+	}
+	if a.Hash() != b.Hash() {
+		t.Fatal("expected the same hash for the same entries")
+	}
+
+	hash := a.Hash()
+	a.Put([]byte{5}, []byte{6})
+	if a.Hash() == hash {
+		t.Fatal("expected the hash to change with a value")
+	}
+
+	// the lengths are hashed along with the bytes
+	c, d := New(), New()
+	c.Put([]byte("ab"), []byte("c"))
+	d.Put([]byte("a"), []byte("bc"))
+	if c.Hash() == d.Hash() {
+		t.Fatal("expected different hashes for differently split entries")
+	}
+}
+
+func TestReader(t *testing.T) {
+	tree := New()
+	for _, c := range treeCases {
+		tree.Put([]byte{c.key}, []byte(c.value))
+	}
+
+	var expected bytes.Buffer
+	if _, err := tree.WriteTo(&expected); err != nil {
+		t.Fatalf("failed to write tree: %s", err)
+	}
+
+	r := tree.Reader()
+	actual, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failed to read tree: %s", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("failed to close reader: %s", err)
+	}
+
+	if !bytes.Equal(expected.Bytes(), actual) {
+		t.Fatal("read bytes differ from the written ones")
+	}
+
+	actual, err = ioutil.ReadAll(New().Reader())
+	if err != nil || len(actual) != 6 {
+		t.Fatalf("expected only header to be read for empty tree, but got %v, %v", actual, err)
+	}
+}
+
+func TestReaderClose(t *testing.T) {
+	tree := New()
+	for k := 0; k < 1024; k++ {
+		tree.Put([]byte{byte(k >> 8), byte(k)}, nil)
+	}
+
+	r := tree.Reader()
+	if _, err := io.ReadFull(r, make([]byte, 8)); err != nil {
+		t.Fatalf("failed to read: %s", err)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatalf("failed to close reader: %s", err)
+	}
+
+	if _, err := r.Read(make([]byte, 8)); err != io.ErrClosedPipe {
+		t.Fatalf("expected io.ErrClosedPipe after close, but got %v", err)
+	}
+}
+
+func TestRangeReader(t *testing.T) {
+	tree := New()
+	for k := 0; k < 20; k++ {
+		tree.Put([]byte{byte(k)}, []byte{byte(k * 2)})
+	}
+
+	cases := []struct {
+		lo, hi []byte
+	}{
+		{[]byte{5}, []byte{10}},
+		{nil, []byte{3}},
+		{[]byte{17}, nil},
+		{nil, nil},
+		{[]byte{8}, []byte{8}},
+		{[]byte{30}, nil},
+	}
+
+	for _, c := range cases {
+		expected := New()
+		tree.ForEach(func(key, value []byte) {
+			if (c.lo == nil || bytes.Compare(key, c.lo) >= 0) && (c.hi == nil || bytes.Compare(key, c.hi) < 0) {
+				expected.Put(key, value)
+			}
+		})
+
+		r := tree.RangeReader(c.lo, c.hi)
+		loaded := New()
+		if _, err := loaded.ReadFrom(r); err != nil {
+			t.Fatalf("failed to read range: %s", err)
+		}
+		if n, err := r.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+			t.Fatalf("expected the range to be read to the end, but got %d, %v", n, err)
+		}
+		r.Close()
+
+		if !equalEntries(expected, loaded) {
+			t.Fatalf("[%v, %v): expected %v, but got %v", c.lo, c.hi, expected.Entries(), loaded.Entries())
+		}
+	}
+}
+
+func TestRangeReaderClose(t *testing.T) {
+	tree := New()
+	for k := 0; k < 1024; k++ {
+		tree.Put([]byte{byte(k >> 8), byte(k)}, nil)
+	}
+
+	r := tree.RangeReader([]byte{1}, nil)
+	if _, err := io.ReadFull(r, make([]byte, 8)); err != nil {
+		t.Fatalf("failed to read: %s", err)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatalf("failed to close reader: %s", err)
+	}
+
+	if _, err := r.Read(make([]byte, 8)); err != io.ErrClosedPipe {
+		t.Fatalf("expected io.ErrClosedPipe after close, but got %v", err)
+	}
+}
+
+func equalEntries(a, b *Tree) bool {
+	return reflect.DeepEqual(a.Entries(), b.Entries())
+}
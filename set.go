@@ -0,0 +1,89 @@
+package rbytree
+
+import (
+	"bytes"
+)
+
+// Difference returns a new tree holding copies of the entries of a
+// with keys that are not in b. It walks both trees in ascending key
+// order at once, so it takes O(n + m) time. The trees are not modified.
+func Difference(a, b *Tree) *Tree {
+	entries := make([]Entry, 0)
+	walkBoth(a, b, func(x, y *node) {
+		if x != nil && y == nil {
+			entries = append(entries, Entry{copyBytes(x.key), copyBytes(x.value)})
+		}
+	})
+
+	difference := New()
+	difference.setRoot(buildFromSorted(entries))
+
+	return difference
+}
+
+// Intersection returns a new tree holding copies of the entries of a
+// with keys that are also in b, so the values are taken from a.
+// It walks both trees in ascending key order at once, so it takes
+// O(n + m) time. The trees are not modified.
+func Intersection(a, b *Tree) *Tree {
+	entries := make([]Entry, 0)
+	walkBoth(a, b, func(x, y *node) {
+		if x != nil && y != nil {
+			entries = append(entries, Entry{copyBytes(x.key), copyBytes(x.value)})
+		}
+	})
+
+	intersection := New()
+	intersection.setRoot(buildFromSorted(entries))
+
+	return intersection
+}
+
+// Union returns a new tree holding copies of the entries of both trees,
+// with the values taken from b for the keys that are in both of them.
+// It walks both trees in ascending key order at once, so it takes
+// O(n + m) time. The trees are not modified.
+func Union(a, b *Tree) *Tree {
+	entries := make([]Entry, 0)
+	walkBoth(a, b, func(x, y *node) {
+		if y != nil {
+			entries = append(entries, Entry{copyBytes(y.key), copyBytes(y.value)})
+		} else {
+			entries = append(entries, Entry{copyBytes(x.key), copyBytes(x.value)})
+		}
+	})
+
+	union := New()
+	union.setRoot(buildFromSorted(entries))
+
+	return union
+}
+
+// walkBoth traverses the keys of both trees in ascending key order
+// and calls visit once per key with the nodes of the key in a and b,
+// nil for the tree without the key.
+func walkBoth(a, b *Tree, visit func(x, y *node)) {
+	x, y := live(a.leftmost), live(b.leftmost)
+	for x != nil || y != nil {
+		cmp := 0
+		if x == nil {
+			cmp = 1
+		} else if y == nil {
+			cmp = -1
+		} else {
+			cmp = bytes.Compare(x.key, y.key)
+		}
+
+		switch {
+		case cmp < 0:
+			visit(x, nil)
+			x = live(successor(x))
+		case cmp > 0:
+			visit(nil, y)
+			y = live(successor(y))
+		default:
+			visit(x, y)
+			x, y = live(successor(x)), live(successor(y))
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package rbytree
+
+import (
+	"bytes"
+	"testing"
+)
+
+// setCases holds the keys of the trees a and b.
+var setCases = []struct {
+	a, b []byte
+}{
+	{nil, nil},
+	{[]byte{1, 2, 3}, nil},
+	{nil, []byte{1, 2, 3}},
+	{[]byte{1, 2, 3}, []byte{1, 2, 3}},
+	{[]byte{1, 3, 5, 7, 9}, []byte{2, 3, 4, 7, 10}},
+	{[]byte{1, 2}, []byte{5, 6}},
+	{[]byte{5, 6}, []byte{1, 2}},
+}
+
+// setTrees builds a with values 'a' and b with values 'b'.
+func setTrees(aKeys, bKeys []byte) (*Tree, *Tree) {
+	a, b := New(), New()
+	for _, key := range aKeys {
+		a.Put([]byte{key}, []byte("a"))
+	}
+	for _, key := range bKeys {
+		b.Put([]byte{key}, []byte("b"))
+	}
+
+	return a, b
+}
+
+// checkSetResult checks that the result is a valid tree holding exactly
+// the expected keys with the values chosen by value.
+func checkSetResult(t *testing.T, result *Tree, expected []byte, value func(key byte) string) {
+	if err := result.Validate(); err != nil {
+		t.Fatalf("result is not valid: %s", err)
+	}
+
+	keys := make([]byte, 0)
+	result.ForEach(func(key, v []byte) {
+		if string(v) != value(key[0]) {
+			t.Fatalf("expected value %s for key %d, but got %s", value(key[0]), key[0], v)
+		}
+		keys = append(keys, key[0])
+	})
+
+	if !bytes.Equal(keys, expected) {
+		t.Fatalf("expected keys %v, but got %v", expected, keys)
+	}
+}
+
+func contains(keys []byte, key byte) bool {
+	return bytes.IndexByte(keys, key) >= 0
+}
+
+func TestDifference(t *testing.T) {
+	for _, c := range setCases {
+		a, b := setTrees(c.a, c.b)
+
+		expected := make([]byte, 0)
+		for _, key := range c.a {
+			if !contains(c.b, key) {
+				expected = append(expected, key)
+			}
+		}
+
+		checkSetResult(t, Difference(a, b), expected, func(key byte) string {
+			return "a"
+		})
+
+		if a.Size() != len(c.a) || b.Size() != len(c.b) {
+			t.Fatal("expected the trees not to be modified")
+		}
+	}
+}
+
+func TestIntersection(t *testing.T) {
+	for _, c := range setCases {
+		a, b := setTrees(c.a, c.b)
+
+		expected := make([]byte, 0)
+		for _, key := range c.a {
+			if contains(c.b, key) {
+				expected = append(expected, key)
+			}
+		}
+
+		intersection := Intersection(a, b)
+		if intersection == nil {
+			t.Fatal("expected non-nil tree")
+		}
+		checkSetResult(t, intersection, expected, func(key byte) string {
+			return "a"
+		})
+
+		if a.Size() != len(c.a) || b.Size() != len(c.b) {
+			t.Fatal("expected the trees not to be modified")
+		}
+	}
+}
+
+func TestUnion(t *testing.T) {
+	for _, c := range setCases {
+		a, b := setTrees(c.a, c.b)
+
+		expected := make([]byte, 0)
+		for key := byte(0); key < 16; key++ {
+			if contains(c.a, key) || contains(c.b, key) {
+				expected = append(expected, key)
+			}
+		}
+
+		checkSetResult(t, Union(a, b), expected, func(key byte) string {
+			if contains(c.b, key) {
+				return "b"
+			}
+
+			return "a"
+		})
+
+		if a.Size() != len(c.a) || b.Size() != len(c.b) {
+			t.Fatal("expected the trees not to be modified")
+		}
+	}
+}
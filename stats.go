@@ -0,0 +1,62 @@
+package rbytree
+
+import (
+	"sync/atomic"
+)
+
+// Stats holds the cumulative counters of the work done by the tree
+// created with NewWithStats.
+type Stats struct {
+	// Comparisons is the number of key comparisons, or visited nodes,
+	// made while searching the keys for Put, Get, Delete and
+	// the other lookups of a single key.
+	Comparisons int
+	// InsertFixups is the number of rebalancing passes after insertions.
+	InsertFixups int
+	// InsertRotations is the number of rotations made by
+	// the rebalancing after insertions.
+	InsertRotations int
+	// DeleteFixups is the number of rebalancing passes after deletions,
+	// which are required only when a black node is removed.
+	DeleteFixups int
+	// DeleteRotations is the number of rotations made by
+	// the rebalancing after deletions.
+	DeleteRotations int
+}
+
+// counters holds the counters behind Stats. They are updated atomically,
+// because the lookups count comparisons too and may run concurrently.
+// The 64-bit fields come first to keep them aligned on 32-bit platforms.
+type counters struct {
+	comparisons     int64
+	insertFixups    int64
+	insertRotations int64
+	deleteFixups    int64
+	deleteRotations int64
+}
+
+// NewWithStats creates new empty instance of Red-black tree that
+// counts the work done by its operations, see Stats.
+// The counters are updated atomically, so the lookups, like Get,
+// remain safe to run concurrently with each other.
+// Trees created with New do not count anything.
+func NewWithStats() *Tree {
+	return &Tree{stats: &counters{}}
+}
+
+// Stats returns the cumulative counters of the work done by the tree
+// since its creation. They are always zero unless the tree is created
+// with NewWithStats.
+func (t *Tree) Stats() Stats {
+	if t.stats == nil {
+		return Stats{}
+	}
+
+	return Stats{
+		Comparisons:     int(atomic.LoadInt64(&t.stats.comparisons)),
+		InsertFixups:    int(atomic.LoadInt64(&t.stats.insertFixups)),
+		InsertRotations: int(atomic.LoadInt64(&t.stats.insertRotations)),
+		DeleteFixups:    int(atomic.LoadInt64(&t.stats.deleteFixups)),
+		DeleteRotations: int(atomic.LoadInt64(&t.stats.deleteRotations)),
+	}
+}
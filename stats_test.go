@@ -0,0 +1,82 @@
+package rbytree
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	tree := NewWithStats()
+
+	if stats := tree.Stats(); stats != (Stats{}) {
+		t.Fatalf("expected zero stats for the new tree, but got %+v", stats)
+	}
+
+	// the third ascending insertion requires exactly one rotation
+	tree.Put([]byte{1}, nil)
+	tree.Put([]byte{2}, nil)
+	tree.Put([]byte{3}, nil)
+
+	stats := tree.Stats()
+	if stats.InsertRotations != 1 {
+		t.Fatalf("expected 1 rotation on insertion, but got %d", stats.InsertRotations)
+	}
+	if stats.InsertFixups != 2 {
+		t.Fatalf("expected 2 rebalancing passes on insertion, but got %d", stats.InsertFixups)
+	}
+
+	comparisons := stats.Comparisons
+	tree.Get([]byte{3})
+	if visited := tree.Stats().Comparisons - comparisons; visited != 2 {
+		t.Fatalf("expected 2 comparisons for Get, but got %d", visited)
+	}
+
+	for k := 4; k < 64; k++ {
+		tree.Put([]byte{byte(k)}, nil)
+	}
+	for k := 1; k < 64; k++ {
+		tree.Delete([]byte{byte(k)})
+	}
+
+	stats = tree.Stats()
+	if stats.DeleteFixups == 0 || stats.DeleteRotations == 0 {
+		t.Fatalf("expected rebalancing on deletion, but got %+v", stats)
+	}
+}
+
+func TestStatsForTreeWithoutStats(t *testing.T) {
+	tree := New()
+	for k := 0; k < 64; k++ {
+		tree.Put([]byte{byte(k)}, nil)
+		tree.Get([]byte{byte(k)})
+	}
+
+	if stats := tree.Stats(); stats != (Stats{}) {
+		t.Fatalf("expected zero stats, but got %+v", stats)
+	}
+}
+
+func TestStatsForConcurrentReaders(t *testing.T) {
+	tree := NewWithStats()
+	for k := 0; k < 64; k++ {
+		tree.Put([]byte{byte(k)}, nil)
+	}
+	comparisons := tree.Stats().Comparisons
+
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := 0; k < 64; k++ {
+				tree.Get([]byte{byte(k)})
+				tree.Contains([]byte{byte(k)})
+			}
+		}()
+	}
+	wg.Wait()
+
+	if stats := tree.Stats(); stats.Comparisons <= comparisons {
+		t.Fatalf("expected the lookups to be counted, but got %+v", stats)
+	}
+}
@@ -0,0 +1,67 @@
+package rbytree
+
+import (
+	"context"
+)
+
+// Stream returns a channel that yields copies of all the entries of
+// the tree in ascending key order and is closed after the last one.
+// The entries are sent by a separate goroutine, so the tree must not
+// be modified until the channel is closed.
+// Caution! If the consumer stops receiving before the channel is closed,
+// the goroutine is blocked forever, so read the channel to the end
+// or use StreamContext.
+func (t *Tree) Stream() <-chan Entry {
+	entries := make(chan Entry)
+	go func() {
+		defer close(entries)
+
+		t.ForEach(func(key, value []byte) {
+			entries <- Entry{copyBytes(key), copyBytes(value)}
+		})
+	}()
+
+	return entries
+}
+
+// StreamContext returns a channel that yields copies of all the entries
+// of the tree in ascending key order like Stream, but it is also closed
+// when the context is done, which stops the goroutine sending
+// the entries, so the consumer may stop receiving them early by
+// cancelling the context. The tree must not be modified until
+// the channel is closed.
+func (t *Tree) StreamContext(ctx context.Context) <-chan Entry {
+	entries := make(chan Entry)
+	go func() {
+		defer close(entries)
+
+		send := func(key, value []byte) bool {
+			// select picks randomly among the ready cases,
+			// so the cancellation is checked first
+			if ctx.Err() != nil {
+				return false
+			}
+
+			select {
+			case entries <- Entry{copyBytes(key), copyBytes(value)}:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		for current := live(t.leftmost); current != nil; current = live(successor(current)) {
+			if !send(current.key, current.value) {
+				return
+			}
+
+			for _, duplicate := range current.duplicates {
+				if !send(current.key, duplicate) {
+					return
+				}
+			}
+		}
+	}()
+
+	return entries
+}
@@ -0,0 +1,84 @@
+package rbytree
+
+import (
+	"context"
+	"testing"
+)
+
+func TestStream(t *testing.T) {
+	tree := New()
+	for _, c := range treeCases {
+		tree.Put([]byte{c.key}, []byte(c.value))
+	}
+
+	streamed := make([]Entry, 0)
+	for entry := range tree.Stream() {
+		streamed = append(streamed, entry)
+	}
+
+	expected := tree.Entries()
+	if len(streamed) != len(expected) {
+		t.Fatalf("expected %d entries, but got %d", len(expected), len(streamed))
+	}
+	for i := range expected {
+		if string(streamed[i].Key) != string(expected[i].Key) || string(streamed[i].Value) != string(expected[i].Value) {
+			t.Fatalf("expected %v at %d, but got %v", expected[i], i, streamed[i])
+		}
+	}
+}
+
+func TestStreamForEmptyTree(t *testing.T) {
+	for entry := range New().Stream() {
+		t.Fatalf("entry is not expected: %v", entry)
+	}
+}
+
+func TestStreamContext(t *testing.T) {
+	tree := New()
+	for _, c := range treeCases {
+		tree.Put([]byte{c.key}, []byte(c.value))
+	}
+
+	streamed := make([]Entry, 0)
+	for entry := range tree.StreamContext(context.Background()) {
+		streamed = append(streamed, entry)
+	}
+
+	if len(streamed) != tree.Size() {
+		t.Fatalf("expected %d entries, but got %d", tree.Size(), len(streamed))
+	}
+	for i := 1; i < len(streamed); i++ {
+		if string(streamed[i-1].Key) >= string(streamed[i].Key) {
+			t.Fatalf("expected ascending order, but got %v after %v", streamed[i].Key, streamed[i-1].Key)
+		}
+	}
+}
+
+func TestStreamContextCancel(t *testing.T) {
+	tree := New()
+	for k := 0; k < 1000; k++ {
+		tree.Put([]byte{byte(k >> 8), byte(k)}, nil)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	entries := tree.StreamContext(ctx)
+
+	for i := 0; i < 10; i++ {
+		<-entries
+	}
+	cancel()
+
+	// the channel is closed after at most one more entry
+	// that might have been sent before the cancellation was noticed
+	received := 0
+	for range entries {
+		received++
+	}
+	if received > 1 {
+		t.Fatalf("expected the stream to stop after cancellation, but got %d more entries", received)
+	}
+
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("tree is not valid after cancellation: %s", err)
+	}
+}
@@ -0,0 +1,56 @@
+package rbytree
+
+// NewWithTombstones creates new empty instance of Red-black tree whose
+// Delete, Remove and the other removals of the keys, like DeleteFunc,
+// RemoveRange or TruncateToFirst, only mark the nodes of the keys as
+// tombstoned instead of unlinking them, and Put of a tombstoned key
+// revives its node without any rebalancing. The methods rebuilding
+// the whole tree, like Retain, Rebuild or ReplaceAll, drop the tombstones. It suits the workloads that delete and insert
+// the same keys repeatedly, at the cost of the memory held by
+// the tombstoned nodes and the time spent to skip them until Purge.
+// Size, the lookups, the traversals, the positional and the range
+// methods skip the tombstoned nodes, only the methods exposing
+// the structure, like ForEachNode or ColorCounts, see them.
+// The positional methods, like Median or IndexOf, take O(n) time
+// instead of O(log n) until Purge.
+func NewWithTombstones() *Tree {
+	return &Tree{softDelete: true}
+}
+
+// Purge unlinks all the tombstoned nodes from the tree, rebalances it
+// and returns the number of the unlinked nodes.
+func (t *Tree) Purge() int {
+	if t.tombstones == 0 {
+		return 0
+	}
+
+	tombstoned := make([]*node, 0, t.tombstones)
+	for current := t.leftmost; current != nil; current = successor(current) {
+		if current.deleted {
+			tombstoned = append(tombstoned, current)
+		}
+	}
+
+	t.unlinkAll(tombstoned)
+
+	return len(tombstoned)
+}
+
+// tombstone marks the node as deleted and releases its values.
+func (t *Tree) tombstone(n *node) {
+	value := n.value
+	t.unindexNode(n)
+	t.removeOrder(n)
+
+	n.deleted = true
+	n.value, n.duplicates = nil, nil
+	t.tombstones++
+	t.version++
+	t.removeMember(n.key)
+
+	if t.debug {
+		t.check("tombstoning")
+	}
+
+	t.notify(OpDelete, n.key, value)
+}
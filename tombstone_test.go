@@ -0,0 +1,328 @@
+package rbytree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestNewWithTombstones(t *testing.T) {
+	tree := NewWithTombstones()
+	for k := 0; k < 10; k++ {
+		tree.Put([]byte{byte(k)}, []byte{byte(k)})
+	}
+
+	for k := 0; k < 10; k += 2 {
+		if !tree.Delete([]byte{byte(k)}) {
+			t.Fatalf("expected key %d to be deleted", k)
+		}
+	}
+
+	if tree.Delete([]byte{0}) {
+		t.Fatal("expected tombstoned key not to be deleted twice")
+	}
+	if tree.Size() != 5 {
+		t.Fatalf("expected size 5, but got %d", tree.Size())
+	}
+	if len(tree.Path([]byte{9})) == 0 {
+		t.Fatal("expected tombstoned nodes to stay in the tree")
+	}
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("tree is not valid: %s", err)
+	}
+
+	for k := 0; k < 10; k++ {
+		_, ok := tree.Get([]byte{byte(k)})
+		if ok != (k%2 == 1) {
+			t.Fatalf("expected key %d to be found: %v, but got %v", k, k%2 == 1, ok)
+		}
+	}
+
+	keys := make([]byte, 0)
+	tree.ForEach(func(key, value []byte) {
+		keys = append(keys, key[0])
+	})
+	if !bytes.Equal(keys, []byte{1, 3, 5, 7, 9}) {
+		t.Fatalf("expected ForEach to skip tombstoned keys, but got %v", keys)
+	}
+
+	keys = keys[:0]
+	for it := tree.Iterator(); it.HasNext(); {
+		key, _ := it.Next()
+		keys = append(keys, key[0])
+	}
+	if !bytes.Equal(keys, []byte{1, 3, 5, 7, 9}) {
+		t.Fatalf("expected Iterator to skip tombstoned keys, but got %v", keys)
+	}
+}
+
+func TestNewWithTombstonesRevivesKeys(t *testing.T) {
+	tree := NewWithTombstones()
+	tree.Put([]byte{1}, []byte{1})
+	tree.Put([]byte{2}, []byte{2})
+	tree.Delete([]byte{1})
+
+	root := tree.root
+	prev, exists := tree.Put([]byte{1}, []byte{10})
+	if exists || prev != nil {
+		t.Fatalf("expected revived key to be reported as new, but got %v, %v", prev, exists)
+	}
+	if tree.root != root {
+		t.Fatal("expected revival not to restructure the tree")
+	}
+
+	if value, ok := tree.Get([]byte{1}); !ok || !bytes.Equal(value, []byte{10}) {
+		t.Fatalf("expected revived value 10, but got %v, %v", value, ok)
+	}
+	if tree.Size() != 2 {
+		t.Fatalf("expected size 2, but got %d", tree.Size())
+	}
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("tree is not valid: %s", err)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	for n := 0; n <= 64; n++ {
+		tree := NewWithTombstones()
+		for k := 0; k < n; k++ {
+			tree.Put([]byte{byte(k)}, []byte{byte(k)})
+		}
+		for k := 0; k < n; k += 3 {
+			tree.Delete([]byte{byte(k)})
+		}
+
+		if purged := tree.Purge(); purged != (n+2)/3 {
+			t.Fatalf("expected %d purged nodes, but got %d", (n+2)/3, purged)
+		}
+		if err := tree.Validate(); err != nil {
+			t.Fatalf("tree of size %d is not valid after purge: %s", n, err)
+		}
+		if tree.size != tree.Size() || tree.Size() != n-(n+2)/3 {
+			t.Fatalf("expected size %d, but got %d", n-(n+2)/3, tree.Size())
+		}
+		if tree.Purge() != 0 {
+			t.Fatal("expected nothing to purge")
+		}
+	}
+}
+
+func TestNewWithTombstonesRemovals(t *testing.T) {
+	removals := []struct {
+		name   string
+		remove func(tree *Tree)
+	}{
+		{"Remove", func(tree *Tree) {
+			tree.Remove([]byte{2})
+			tree.Remove([]byte{5})
+		}},
+		{"DeleteFunc", func(tree *Tree) {
+			tree.DeleteFunc(func(key, value []byte) bool {
+				return key[0] == 2 || key[0] == 5
+			})
+		}},
+		{"ForEachDeletable", func(tree *Tree) {
+			tree.ForEachDeletable(func(key, value []byte) bool {
+				return key[0] == 2 || key[0] == 5
+			})
+		}},
+		{"RemoveRange", func(tree *Tree) {
+			tree.RemoveRange([]byte{2}, []byte{3})
+			tree.RemoveRange([]byte{5}, []byte{6})
+		}},
+		{"TruncateToLast", func(tree *Tree) {
+			tree.TruncateToLast(8)
+		}},
+	}
+
+	for _, r := range removals {
+		tree := NewWithTombstones()
+		for k := 0; k < 10; k++ {
+			tree.Put([]byte{byte(k)}, []byte{byte(k)})
+		}
+
+		r.remove(tree)
+
+		if tree.Size() != 8 || tree.tombstones != 2 || tree.size != 10 {
+			t.Fatalf("%s: expected 8 keys and 2 tombstones, but got %d keys and %d tombstones", r.name, tree.Size(), tree.tombstones)
+		}
+		if err := tree.Validate(); err != nil {
+			t.Fatalf("%s: tree is not valid: %s", r.name, err)
+		}
+
+		if purged := tree.Purge(); purged != 2 || tree.size != 8 {
+			t.Fatalf("%s: expected 2 purged nodes, but got %d", r.name, purged)
+		}
+	}
+}
+
+func TestNewWithTombstonesRebuild(t *testing.T) {
+	tree := NewWithTombstones()
+	for k := 0; k < 10; k++ {
+		tree.Put([]byte{byte(k)}, []byte{byte(k)})
+	}
+	tree.Delete([]byte{3})
+
+	tree.Rebuild()
+
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("tree is not valid after rebuild: %s", err)
+	}
+	if tree.Size() != 9 || tree.size != 9 {
+		t.Fatalf("expected rebuild to drop the tombstoned node, but got size %d", tree.size)
+	}
+	if _, ok := tree.Get([]byte{3}); ok {
+		t.Fatal("expected deleted key not to be revived by rebuild")
+	}
+}
+
+// tombstonedTree returns a tree holding the keys 2, 3, 5, 6 and 7
+// with the tombstoned keys 0, 1, 4, 8 and 9 between them.
+func tombstonedTree() *Tree {
+	tree := NewWithTombstones()
+	for k := 0; k < 10; k++ {
+		tree.Put([]byte{byte(k)}, []byte{byte(k)})
+	}
+	for _, k := range []byte{0, 1, 4, 8, 9} {
+		tree.Delete([]byte{k})
+	}
+
+	return tree
+}
+
+func TestNewWithTombstonesLookups(t *testing.T) {
+	tree := tombstonedTree()
+
+	if key, _, ok := tree.First(); !ok || key[0] != 2 {
+		t.Fatalf("expected first key 2, but got %v, %v", key, ok)
+	}
+	if key, _, ok := tree.Last(); !ok || key[0] != 7 {
+		t.Fatalf("expected last key 7, but got %v, %v", key, ok)
+	}
+
+	_, prev, next, found := tree.GetWithNeighbors([]byte{4})
+	if found || prev[0] != 3 || next[0] != 5 {
+		t.Fatalf("expected not found key 4 between 3 and 5, but got %v, %v, %v", prev, next, found)
+	}
+	_, prev, next, found = tree.GetWithNeighbors([]byte{5})
+	if !found || prev[0] != 3 || next[0] != 6 {
+		t.Fatalf("expected found key 5 between 3 and 6, but got %v, %v, %v", prev, next, found)
+	}
+
+	if _, ok := tree.Depth([]byte{4}); ok {
+		t.Fatal("expected tombstoned key not to be found")
+	}
+
+	if _, ok := tree.IndexOf([]byte{4}); ok {
+		t.Fatal("expected tombstoned key not to be found")
+	}
+	if index, ok := tree.IndexOf([]byte{5}); !ok || index != 2 {
+		t.Fatalf("expected index 2, but got %d, %v", index, ok)
+	}
+	if index, ok := tree.FloorIndex([]byte{4}); !ok || index != 1 {
+		t.Fatalf("expected floor index 1, but got %d, %v", index, ok)
+	}
+	if index, ok := tree.CeilingIndex([]byte{4}); !ok || index != 2 {
+		t.Fatalf("expected ceiling index 2, but got %d, %v", index, ok)
+	}
+	if _, ok := tree.CeilingIndex([]byte{8}); ok {
+		t.Fatal("expected no ceiling index")
+	}
+
+	if key, _, ok := tree.Median(); !ok || key[0] != 5 {
+		t.Fatalf("expected median 5, but got %v, %v", key, ok)
+	}
+	if key, _, ok := tree.Quantile(1); !ok || key[0] != 7 {
+		t.Fatalf("expected quantile 7, but got %v, %v", key, ok)
+	}
+	if points := tree.SplitPoints(5); !reflect.DeepEqual(points, [][]byte{{3}, {5}, {6}, {7}}) {
+		t.Fatalf("expected split points 3, 5, 6 and 7, but got %v", points)
+	}
+
+	prefixes := NewWithTombstones()
+	prefixes.Put([]byte("a"), nil)
+	prefixes.Put([]byte("ab"), nil)
+	prefixes.Put([]byte("abc"), nil)
+	prefixes.Delete([]byte("abc"))
+	if key, _, ok := prefixes.LongestPrefixMatch([]byte("abcd")); !ok || string(key) != "ab" {
+		t.Fatalf("expected longest prefix ab, but got %s, %v", key, ok)
+	}
+
+	numbers := NewWithTombstones()
+	for _, n := range []uint64{10, 20, 30} {
+		var key [8]byte
+		binary.BigEndian.PutUint64(key[:], n)
+		numbers.Put(key[:], nil)
+	}
+	var deleted [8]byte
+	binary.BigEndian.PutUint64(deleted[:], 20)
+	numbers.Delete(deleted[:])
+	if key, _, ok := numbers.ClosestUint64(19); !ok || binary.BigEndian.Uint64(key) != 10 {
+		t.Fatalf("expected closest key 10, but got %v, %v", key, ok)
+	}
+}
+
+func TestNewWithTombstonesRanges(t *testing.T) {
+	tree := tombstonedTree()
+
+	keys := make([]byte, 0)
+	visited := tree.RangeLimit(nil, 10, func(key, value []byte) {
+		keys = append(keys, key[0])
+	})
+	if visited != 5 || !bytes.Equal(keys, []byte{2, 3, 5, 6, 7}) {
+		t.Fatalf("expected RangeLimit to visit keys 2, 3, 5, 6 and 7, but got %v", keys)
+	}
+
+	keys = keys[:0]
+	tree.RangeReverse(nil, nil, func(key, value []byte) {
+		keys = append(keys, key[0])
+	})
+	if !bytes.Equal(keys, []byte{7, 6, 5, 3, 2}) {
+		t.Fatalf("expected RangeReverse to visit keys 7, 6, 5, 3 and 2, but got %v", keys)
+	}
+
+	entries, next := tree.Page(nil, 3)
+	if len(entries) != 3 || entries[2].Key[0] != 5 || next[0] != 5 {
+		t.Fatalf("expected first page up to key 5, but got %v, %v", entries, next)
+	}
+	entries, next = tree.Page(next, 3)
+	if len(entries) != 2 || entries[0].Key[0] != 6 || next != nil {
+		t.Fatalf("expected last page from key 6, but got %v, %v", entries, next)
+	}
+
+	if counts := tree.CountByPrefixes([][]byte{{}, {4}, {5}}); !reflect.DeepEqual(counts, []int{5, 0, 1}) {
+		t.Fatalf("expected counts 5, 0 and 1, but got %v", counts)
+	}
+
+	bitmap, ok := tree.SingleByteBitmap()
+	if !ok || bitmap[0] != 0xec {
+		t.Fatalf("expected bitmap of keys 2, 3, 5, 6 and 7, but got %v, %v", bitmap[0], ok)
+	}
+}
+
+func TestNewWithTombstonesAllDeleted(t *testing.T) {
+	tree := NewWithTombstones()
+	for k := 0; k < 5; k++ {
+		tree.Put([]byte{byte(k)}, []byte{byte(k)})
+	}
+	for k := 0; k < 5; k++ {
+		tree.Delete([]byte{byte(k)})
+	}
+
+	if _, _, ok := tree.First(); ok {
+		t.Fatal("expected no first key")
+	}
+	if _, _, ok := tree.Last(); ok {
+		t.Fatal("expected no last key")
+	}
+	if _, _, ok := tree.Median(); ok {
+		t.Fatal("expected no median")
+	}
+	if _, _, ok := tree.Quantile(0.5); ok {
+		t.Fatal("expected no quantile")
+	}
+	if entries, next := tree.Page(nil, 10); len(entries) != 0 || next != nil {
+		t.Fatalf("expected empty page, but got %v, %v", entries, next)
+	}
+}
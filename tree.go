@@ -2,6 +2,14 @@ package rbytree
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"math/rand"
+	"sort"
+	"sync/atomic"
 )
 
 // Tree holds red-black tree.
@@ -10,8 +18,59 @@ import (
 type Tree struct {
 	root *node
 	size int
+	// leftmost and rightmost cache the nodes with the least and
+	// the greatest keys to shortcut insertions at the edges
+	leftmost  *node
+	rightmost *node
+	// stats is nil unless the tree is created with NewWithStats
+	stats *counters
+	// version is incremented on every modification to detect
+	// the modifications during the iteration
+	version uint64
+	// multi allows multiple values per key
+	multi bool
+	// pool holds the preallocated nodes for the insertions,
+	// see NewWithCapacity
+	pool []node
+	// softDelete makes Delete tombstone the nodes instead of
+	// unlinking them, see NewWithTombstones
+	softDelete bool
+	// tombstones is the number of the tombstoned nodes,
+	// which are counted by size
+	tombstones int
+	onChange   func(op Op, key, value []byte)
+	// loader is nil unless the tree is created with NewWithValueLoader
+	loader func(key []byte) ([]byte, bool)
+	// debug makes Put and Delete validate the tree, see NewDebug
+	debug bool
+	// members is the bitset of the keys of memberWidth bytes,
+	// see NewWithMembershipIndex
+	members     []uint64
+	memberWidth int
+	// valueIndex maps the hashes of the values to the numbers of
+	// the values with the hash per key, see NewWithValueIndex
+	valueIndex map[uint64]map[string]int
+	// ordered links the nodes from oldest to newest in insertion order,
+	// see NewWithInsertionOrder
+	ordered bool
+	oldest  *node
+	newest  *node
 }
 
+// Op describes the kind of the mutation reported to the observer
+// registered with OnChange.
+type Op byte
+
+const (
+	// OpInsert is reported when a new key is added to the tree,
+	// or a value is added to an existing key of a multi tree.
+	OpInsert Op = iota
+	// OpUpdate is reported when the value of an existing key is overridden.
+	OpUpdate
+	// OpDelete is reported when a key is removed from the tree.
+	OpDelete
+)
+
 type color byte
 
 const (
@@ -27,6 +86,23 @@ type node struct {
 	left   *node
 	right  *node
 	color  color
+	// size is the number of nodes in the subtree rooted at the node
+	size int
+	// duplicates holds the values added after the first one
+	// to the key of a multi tree
+	duplicates [][]byte
+	// deleted marks the tombstoned node
+	deleted bool
+	// older and newer link the nodes in insertion order,
+	// see NewWithInsertionOrder
+	older *node
+	newer *node
+}
+
+// Entry holds a key and the associated value.
+type Entry struct {
+	Key   []byte
+	Value []byte
 }
 
 // New creates new empty instance of Red-black tree.
@@ -34,92 +110,1820 @@ func New() *Tree {
 	return &Tree{}
 }
 
+// NewWithCapacity creates new empty instance of Red-black tree that
+// preallocates n nodes in a contiguous block for the first n insertions,
+// which reduces the allocations and improves the memory locality of
+// a bulk load of known size. Further insertions allocate as usual.
+// The block is released only when all of its nodes are unreachable.
+func NewWithCapacity(n int) *Tree {
+	if n <= 0 {
+		return New()
+	}
+
+	return &Tree{pool: make([]node, n)}
+}
+
+// NewMultiTree creates new empty instance of Red-black tree that
+// holds multiple values per key. Put appends the value to the values
+// of the existing key instead of overriding it, Get returns the first
+// value of the key, GetAll returns all of them, ForEach and Iterator
+// visit all of them in insertion order, and Delete removes all of them.
+// Size reports the number of distinct keys.
+// Filter and MapValues build ordinary trees from the first values.
+func NewMultiTree() *Tree {
+	return &Tree{multi: true}
+}
+
+// FromMap creates new instance of Red-black tree holding
+// all the entries of the map.
+func FromMap(m map[string][]byte) *Tree {
+	t := New()
+	for key, value := range m {
+		t.Put([]byte(key), value)
+	}
+
+	return t
+}
+
+// FromSlices creates new instance of Red-black tree and puts the keys
+// with the values at the same positions into it in the order of
+// the slices, so the keys might be unsorted and later values override
+// earlier ones. It returns an error if the slices differ in length.
+func FromSlices(keys, values [][]byte) (*Tree, error) {
+	if len(keys) != len(values) {
+		return nil, fmt.Errorf("expected %d values for %d keys, but got %d", len(keys), len(keys), len(values))
+	}
+
+	t := New()
+	for i, key := range keys {
+		t.Put(key, values[i])
+	}
+
+	return t, nil
+}
+
+// BuildFromUnsortedDeterministic creates new instance of Red-black tree
+// and puts the pairs into it in the pseudo-random order determined by
+// the seed, so that the same seed always yields the same tree. It is
+// meant for reproducible tests of different insertion orders.
+// If the keys are not unique, the seed also determines which of
+// the values of a key is put last.
+func BuildFromUnsortedDeterministic(seed int64, pairs []Entry) *Tree {
+	t := New()
+	for _, i := range rand.New(rand.NewSource(seed)).Perm(len(pairs)) {
+		t.Put(pairs[i].Key, pairs[i].Value)
+	}
+
+	return t
+}
+
+// IsStrictlySorted returns true if the keys of the pairs are strictly
+// increasing in the order of the tree, that is they are sorted
+// by bytes.Compare and unique.
+func IsStrictlySorted(pairs []Entry) bool {
+	for i := 1; i < len(pairs); i++ {
+		if bytes.Compare(pairs[i-1].Key, pairs[i].Key) >= 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
 // Put inserts the key with the associated value into the tree.
 // If the key is already in the map, it overrides the value and
-// returns the previous value.
+// returns the previous value. For a multi tree, it appends the value
+// to the values of the key instead and returns the last of them.
 // Since the value might be null, it also returns a boolean flag
 // to distinguish between existent keys and not.
 func (t *Tree) Put(key []byte, value []byte) ([]byte, bool) {
+	prev, exists, _ := t.put(key, value)
+
+	return prev, exists
+}
+
+// PutReport inserts the key with the associated value into the tree
+// like Put and returns the number of rotations made by the rebalancing,
+// which is always 0 if the key is already in the tree.
+func (t *Tree) PutReport(key, value []byte) (rotations int) {
+	_, _, rotations = t.put(key, value)
+
+	return rotations
+}
+
+// put inserts the key with the associated value into the tree like Put
+// and also returns the number of rotations made by the rebalancing.
+func (t *Tree) put(key []byte, value []byte) ([]byte, bool, int) {
 	// too guarantee that the invariants are not violated
 	key = copyBytes(key)
 
-	newNode := &node{key, value, nil, nil, nil, red}
 	if t.root == nil {
+		newNode := t.newNode(key, value)
 		newNode.color = black
-		t.root = newNode
-		t.size = 1
+		t.setRoot(newNode)
+		t.appendOrder(newNode)
 
-		return nil, false
+		t.notify(OpInsert, key, value)
+
+		return nil, false, 0
 	}
 
 	current := t.root
 	var parent *node
 	var cmp int
+	comparisons := 1
+	if cmp = bytes.Compare(key, t.rightmost.key); cmp > 0 {
+		// sequential insertion in ascending order
+		parent, current = t.rightmost, nil
+	} else {
+		comparisons++
+		if cmp = bytes.Compare(key, t.leftmost.key); cmp < 0 {
+			// sequential insertion in descending order
+			parent, current = t.leftmost, nil
+		}
+	}
+
 	for current != nil {
 		parent = current
 
+		comparisons++
 		cmp = bytes.Compare(key, current.key)
 		if cmp == 0 {
-			prev := current.value
-			current.value = value
+			break
+		}
+
+		if cmp < 0 {
+			current = current.left
+		} else {
+			current = current.right
+		}
+	}
+
+	if t.stats != nil {
+		atomic.AddInt64(&t.stats.comparisons, int64(comparisons))
+	}
+
+	if current != nil {
+		prev, exists := t.putExisting(current, value)
+
+		return prev, exists, 0
+	}
+
+	newNode := t.newNode(key, value)
+	if cmp < 0 {
+		parent.left = newNode
+		if parent == t.leftmost {
+			t.leftmost = newNode
+		}
+	} else {
+		parent.right = newNode
+		if parent == t.rightmost {
+			t.rightmost = newNode
+		}
+	}
+	newNode.parent = parent
+
+	for current = parent; current != nil; current = current.parent {
+		current.size++
+	}
+
+	rotations := t.fixAfterInsertion(newNode)
+	if t.stats != nil {
+		atomic.AddInt64(&t.stats.insertFixups, 1)
+		atomic.AddInt64(&t.stats.insertRotations, int64(rotations))
+	}
+
+	t.size++
+	t.version++
+	t.addMember(key)
+	t.indexValue(key, value)
+	t.appendOrder(newNode)
+
+	if t.debug {
+		t.check("insertion")
+	}
+
+	t.notify(OpInsert, key, value)
+
+	return nil, false, rotations
+}
+
+// newNode returns a new red node taken from the pool if it is not
+// exhausted, otherwise allocated.
+func (t *Tree) newNode(key, value []byte) *node {
+	if len(t.pool) == 0 {
+		return &node{key, value, nil, nil, nil, red, 1, nil, false, nil, nil}
+	}
+
+	n := &t.pool[0]
+	t.pool = t.pool[1:]
+	n.key, n.value, n.size = key, value, 1
+
+	return n
+}
+
+// putExisting overrides the value of the existing node, or appends
+// the value to its values for a multi tree, and returns the previous
+// value and true.
+func (t *Tree) putExisting(n *node, value []byte) ([]byte, bool) {
+	t.version++
+
+	if n.deleted {
+		n.deleted = false
+		n.value = value
+		t.tombstones--
+		t.addMember(n.key)
+		t.indexValue(n.key, value)
+		t.appendOrder(n)
+
+		if t.debug {
+			t.check("revival")
+		}
+
+		t.notify(OpInsert, n.key, value)
+
+		return nil, false
+	}
+
+	if t.multi {
+		prev := n.value
+		if len(n.duplicates) > 0 {
+			prev = n.duplicates[len(n.duplicates)-1]
+		}
+
+		n.duplicates = append(n.duplicates, value)
+		t.indexValue(n.key, value)
+
+		t.notify(OpInsert, n.key, value)
+
+		return prev, true
+	}
+
+	prev := n.value
+	n.value = value
+	t.unindexValue(n.key, prev)
+	t.indexValue(n.key, value)
+
+	t.notify(OpUpdate, n.key, value)
+
+	return prev, true
+}
+
+// DuplicateKeyError is returned by PutUnique if the key is already
+// in the tree.
+type DuplicateKeyError struct {
+	Key []byte
+}
+
+func (e *DuplicateKeyError) Error() string {
+	return fmt.Sprintf("key %q already exists", e.Key)
+}
+
+// PutUnique inserts the key with the associated value into the tree
+// only if the key is not in the tree yet, otherwise it returns
+// *DuplicateKeyError holding a copy of the key and leaves the tree
+// unchanged.
+func (t *Tree) PutUnique(key, value []byte) error {
+	if t.getNode(key) != nil {
+		return &DuplicateKeyError{copyBytes(key)}
+	}
+
+	t.Put(key, value)
+
+	return nil
+}
+
+// PutAll inserts all the pairs into the tree in the given order,
+// overriding the values of the existing keys.
+func (t *Tree) PutAll(pairs []Entry) {
+	for _, pair := range pairs {
+		t.Put(pair.Key, pair.Value)
+	}
+}
+
+// PutAllCounting inserts all the pairs into the tree like PutAll and
+// returns the number of newly added keys and the number of the pairs
+// that overrode the value of an existing key, or were appended to its
+// values for a multi tree.
+func (t *Tree) PutAllCounting(pairs []Entry) (inserted, updated int) {
+	for _, pair := range pairs {
+		if _, exists := t.Put(pair.Key, pair.Value); exists {
+			updated++
+		} else {
+			inserted++
+		}
+	}
+
+	return inserted, updated
+}
+
+// PutBatch calls batch with the function that collects the pairs to put
+// into the tree and puts all of them at once after batch returns.
+// The tree is not modified while batch runs. The pairs are applied in
+// the order of the collection, like Put does. The batches of k pairs
+// comparable to the tree of n entries in size, with k of at least
+// n/log2(n), are merged into the tree with a single relinking of its
+// nodes instead of rebalancing it after every insertion, which takes
+// O(n + k log k) time. The smaller batches are put one by one.
+func (t *Tree) PutBatch(batch func(put func(key, value []byte))) {
+	pairs := make([]Entry, 0)
+	batch(func(key, value []byte) {
+		pairs = append(pairs, Entry{copyBytes(key), value})
+	})
+
+	if len(pairs) == 0 {
+		return
+	}
+
+	// the relinking takes O(n) time, which exceeds O(k log n) time
+	// of putting the pairs one by one for the small batches
+	if n := t.Size(); n > 0 && len(pairs) < n/bits.Len(uint(n)) {
+		for _, pair := range pairs {
+			t.put(pair.Key, pair.Value)
+		}
+
+		return
+	}
+
+	// the pairs are sorted by their positions to keep the order
+	// of the collection for the keys added by the batch
+	positions := make([]int, len(pairs))
+	for i := range positions {
+		positions[i] = i
+	}
+	sort.SliceStable(positions, func(i, j int) bool {
+		return bytes.Compare(pairs[positions[i]].Key, pairs[positions[j]].Key) < 0
+	})
+
+	// the observer is called after the relinking in the order of
+	// the collection, so the changes are recorded until then
+	type change struct {
+		op         Op
+		key, value []byte
+	}
+	var changes []change
+	position := 0
+	onChange := t.onChange
+	if onChange != nil {
+		changes = make([]change, len(pairs))
+		t.onChange = func(op Op, key, value []byte) {
+			changes[position] = change{op, key, value}
+		}
+	}
+
+	// merge the sorted pairs into the nodes of the tree
+	merged := make([]*node, 0, t.Size()+len(pairs))
+	added := make([]*node, len(pairs))
+	current := live(t.leftmost)
+	for _, position = range positions {
+		pair := pairs[position]
+		for current != nil && bytes.Compare(current.key, pair.Key) < 0 {
+			merged = append(merged, current)
+			current = live(successor(current))
+		}
+
+		last := len(merged) - 1
+		switch {
+		case current != nil && bytes.Equal(current.key, pair.Key):
+			t.putExisting(current, pair.Value)
+			merged = append(merged, current)
+			current = live(successor(current))
+		case last >= 0 && bytes.Equal(merged[last].key, pair.Key):
+			t.putExisting(merged[last], pair.Value)
+		default:
+			n := t.newNode(pair.Key, pair.Value)
+			added[position] = n
+			merged = append(merged, n)
+			t.notify(OpInsert, pair.Key, pair.Value)
+		}
+	}
+	for ; current != nil; current = live(successor(current)) {
+		merged = append(merged, current)
+	}
+
+	for _, n := range added {
+		if n != nil {
+			t.appendOrder(n)
+		}
+	}
+
+	// the nodes keep their places in the insertion order,
+	// the tombstoned ones are not linked in it
+	oldest, newest := t.oldest, t.newest
+	t.setRoot(linkSorted(merged))
+	t.oldest, t.newest = oldest, newest
+
+	t.onChange = onChange
+	for _, c := range changes {
+		t.notify(c.op, c.key, c.value)
+	}
+}
+
+// Replace sets the value of the key only if the key exists and returns
+// a copy of the previous value and true, otherwise it returns nil and
+// false and does not insert the key. For a multi tree, it replaces
+// the first value of the key.
+func (t *Tree) Replace(key, value []byte) ([]byte, bool) {
+	found := t.getNode(key)
+	if found == nil {
+		return nil, false
+	}
+
+	var prev []byte
+	if found.value != nil {
+		prev = copyBytes(found.value)
+	}
+
+	t.unindexValue(found.key, found.value)
+	t.indexValue(found.key, value)
+	found.value = value
+	t.version++
+
+	t.notify(OpUpdate, found.key, value)
+
+	return prev, true
+}
+
+// CompareAndSwap sets the value of the key to newValue only if the key
+// exists and its current value is equal to oldValue byte by byte.
+// It returns true if the value has been swapped.
+func (t *Tree) CompareAndSwap(key, oldValue, newValue []byte) bool {
+	found := t.getNode(key)
+	if found == nil || !bytes.Equal(found.value, oldValue) {
+		return false
+	}
+
+	t.unindexValue(found.key, found.value)
+	t.indexValue(found.key, newValue)
+	found.value = newValue
+	t.version++
+
+	t.notify(OpUpdate, found.key, newValue)
+
+	return true
+}
+
+// Get searches the key and returns the associated value and true if found,
+// otherwise nil and false.
+func (t *Tree) Get(key []byte) ([]byte, bool) {
+	found := t.getNode(key)
+	if found == nil {
+		return nil, false
+	}
+
+	if found.value == nil && t.loader != nil {
+		return t.loader(found.key)
+	}
+
+	return found.value, true
+}
+
+// GetOrDefault returns the value associated with the key if found,
+// otherwise def. The returned value is not a copy, it is either the slice
+// stored in the tree or def itself, so modifying it modifies the stored
+// value or def.
+func (t *Tree) GetOrDefault(key, def []byte) []byte {
+	if value, ok := t.Get(key); ok {
+		return value
+	}
+
+	return def
+}
+
+// WouldPut returns true if Put of the key would overwrite the existing
+// value, or add one more value to the key of a multi tree, and false if
+// it would insert the key. It does not modify the tree and takes
+// O(log n) time.
+func (t *Tree) WouldPut(key []byte) (exists bool) {
+	return t.getNode(key) != nil
+}
+
+// DeleteFunc removes all the entries for which pred returns true
+// and returns the number of removed entries.
+func (t *Tree) DeleteFunc(pred func(key, value []byte) bool) int {
+	matched := make([]*node, 0)
+	for current := live(t.leftmost); current != nil; current = live(successor(current)) {
+		if pred(current.key, current.value) {
+			matched = append(matched, current)
+		}
+	}
+
+	t.removeAll(matched)
+
+	return len(matched)
+}
+
+// ForEachDeletable traverses tree in ascending key order and removes
+// the entries for which the action returns true during the traversal.
+// For a multi tree, the action is called once per key with the first
+// value, and returning true removes all the values of the key.
+func (t *Tree) ForEachDeletable(action func(key, value []byte) (delete bool)) {
+	for current := live(t.leftmost); current != nil; {
+		// deleteNode keeps the other nodes in place,
+		// so the successor remains valid after the deletion
+		next := live(successor(current))
+		if action(current.key, current.value) {
+			t.removeNode(current)
+		}
+
+		current = next
+	}
+}
+
+// GetAll searches the key and returns all the associated values in
+// insertion order, or nil if the key is not found. Only multi trees
+// hold more than one value per key.
+func (t *Tree) GetAll(key []byte) [][]byte {
+	found := t.getNode(key)
+	if found == nil {
+		return nil
+	}
+
+	values := make([][]byte, 0, len(found.duplicates)+1)
+	values = append(values, found.value)
+	values = append(values, found.duplicates...)
+
+	return values
+}
+
+// GetCopy searches the key and returns a copy of the associated value
+// and true if found, otherwise nil and false.
+// Unlike Get, the returned value can be safely modified.
+func (t *Tree) GetCopy(key []byte) ([]byte, bool) {
+	value, ok := t.Get(key)
+	if !ok {
+		return nil, false
+	}
+
+	if value == nil {
+		return nil, true
+	}
+
+	return copyBytes(value), true
+}
+
+// GetWithNeighbors searches the key and returns the associated value,
+// copies of the keys preceding and following it in ascending order
+// and true if found. If the key is not found, it returns nil value,
+// the keys between which the key would be placed and false.
+// Missing neighbors are returned as nil.
+func (t *Tree) GetWithNeighbors(key []byte) (value, prevKey, nextKey []byte, found bool) {
+	var prev, next *node
+
+	current := t.root
+	for current != nil {
+		cmp := bytes.Compare(key, current.key)
+		if cmp < 0 {
+			next = current
+			current = current.left
+		} else if cmp > 0 {
+			prev = current
+			current = current.right
+		} else {
+			break
+		}
+	}
+
+	if current != nil {
+		if !current.deleted {
+			value = current.value
+			found = true
+		}
+
+		if current.left != nil {
+			prev = maximum(current.left)
+		}
+		if current.right != nil {
+			next = minimum(current.right)
+		}
+	}
+
+	// the neighbors are searched further only if they are tombstoned
+	if prev != nil && prev.deleted {
+		prev = liveBefore(prev)
+	}
+	if next != nil && next.deleted {
+		next = live(next)
+	}
+
+	if prev != nil {
+		prevKey = copyBytes(prev.key)
+	}
+	if next != nil {
+		nextKey = copyBytes(next.key)
+	}
+
+	return value, prevKey, nextKey, found
+}
 
-			return prev, true
+// Delete removes the key from the tree and returns true if the key
+// has been found, otherwise false.
+func (t *Tree) Delete(key []byte) bool {
+	found := t.getNode(key)
+	if found == nil {
+		return false
+	}
+
+	t.removeNode(found)
+
+	return true
+}
+
+// Remove removes the key from the tree and returns a copy of
+// the removed value and true if the key has been found,
+// otherwise nil and false.
+func (t *Tree) Remove(key []byte) ([]byte, bool) {
+	found := t.getNode(key)
+	if found == nil {
+		return nil, false
+	}
+
+	var value []byte
+	if found.value != nil {
+		value = copyBytes(found.value)
+	}
+
+	t.removeNode(found)
+
+	return value, true
+}
+
+// RemoveRange removes all the entries with keys in the range [lo, hi)
+// and returns copies of them in ascending key order. Nil lo or hi means
+// that the range is unbounded on that side.
+func (t *Tree) RemoveRange(lo, hi []byte) []Entry {
+	matched := make([]*node, 0)
+	removed := make([]Entry, 0)
+	t.rangeNodes(lo, hi, func(n *node) bool {
+		matched = append(matched, n)
+		removed = append(removed, Entry{copyBytes(n.key), copyBytes(n.value)})
+		for _, duplicate := range n.duplicates {
+			removed = append(removed, Entry{copyBytes(n.key), copyBytes(duplicate)})
 		}
 
-		if cmp < 0 {
-			current = current.left
-		} else {
-			current = current.right
-		}
+		return true
+	})
+
+	t.removeAll(matched)
+
+	return removed
+}
+
+// TruncateToFirst removes all the keys but the n least ones and returns
+// the number of the removed keys. If n is not less than Size, the tree
+// is not modified.
+func (t *Tree) TruncateToFirst(n int) int {
+	if n < 0 {
+		n = 0
+	}
+
+	removed := t.Size() - n
+	if removed <= 0 {
+		return 0
+	}
+
+	t.removeFrom(t.selectLive(n), successor)
+
+	return removed
+}
+
+// TruncateToLast removes all the keys but the n greatest ones and returns
+// the number of the removed keys. If n is not less than Size, the tree
+// is not modified.
+func (t *Tree) TruncateToLast(n int) int {
+	if n < 0 {
+		n = 0
+	}
+
+	removed := t.Size() - n
+	if removed <= 0 {
+		return 0
+	}
+
+	t.removeFrom(t.selectLive(removed-1), predecessor)
+
+	return removed
+}
+
+// selectLive returns the live node at the zero-based position i
+// in ascending key order, skipping the tombstones. It takes O(n) time
+// if the tree holds tombstones.
+func (t *Tree) selectLive(i int) *node {
+	if t.tombstones == 0 {
+		return t.selectNode(i)
+	}
+
+	current := live(t.leftmost)
+	for ; i > 0; i-- {
+		current = live(successor(current))
+	}
+
+	return current
+}
+
+// removeFrom removes the node and all the nodes following it in
+// the direction of next, including the tombstones.
+func (t *Tree) removeFrom(first *node, next func(*node) *node) {
+	matched := make([]*node, 0)
+	for current := first; current != nil; current = next(current) {
+		matched = append(matched, current)
+	}
+
+	t.removeAll(matched)
+}
+
+// removeNode removes the live node like Delete does, so it only
+// tombstones the node of a tree created with NewWithTombstones.
+func (t *Tree) removeNode(n *node) {
+	if t.softDelete {
+		t.tombstone(n)
+	} else {
+		t.deleteNode(n)
+	}
+}
+
+// removeAll removes the collected nodes like removeNode does, keeping
+// the tombstoned nodes of a tree created with NewWithTombstones.
+func (t *Tree) removeAll(nodes []*node) {
+	if !t.softDelete {
+		t.unlinkAll(nodes)
+		return
+	}
+
+	for _, n := range nodes {
+		if !n.deleted {
+			t.tombstone(n)
+		}
+	}
+}
+
+// unlinkAll unlinks the nodes collected by a traversal, which cannot
+// unlink them itself, since unlinking while traversing would break
+// the traversal. The live nodes are deleted with the notification,
+// the tombstoned ones are unlinked silently.
+func (t *Tree) unlinkAll(nodes []*node) {
+	for _, n := range nodes {
+		if n.deleted {
+			t.unlink(n)
+		} else {
+			t.deleteNode(n)
+		}
+	}
+}
+
+// First returns a copy of the least key in the tree, the associated value
+// and true, or nil, nil and false if the tree is empty.
+func (t *Tree) First() ([]byte, []byte, bool) {
+	first := live(t.leftmost)
+	if first == nil {
+		return nil, nil, false
+	}
+
+	return copyBytes(first.key), first.value, true
+}
+
+// Last returns a copy of the greatest key in the tree, the associated value
+// and true, or nil, nil and false if the tree is empty.
+func (t *Tree) Last() ([]byte, []byte, bool) {
+	last := liveBefore(t.rightmost)
+	if last == nil {
+		return nil, nil, false
+	}
+
+	return copyBytes(last.key), last.value, true
+}
+
+// ForEach traverses tree in ascending key order.
+// It never modifies the tree, so it is safe to run concurrently with
+// other readers, like Get, as long as there are no concurrent writers.
+// The key and the value passed to the action are the slices stored in
+// the tree, not copies, so the traversal does not allocate.
+// Caution! Keys must not be modified, copy them if they need to outlive
+// the action.
+// For a tree created with NewWithValueLoader, the values that are not
+// held in memory are loaded and passed instead, nil if the loader
+// does not find them.
+func (t *Tree) ForEach(action func(key []byte, value []byte)) {
+	if t.root == nil {
+		return
+	}
+
+	for current := live(minimum(t.root)); current != nil; current = live(successor(current)) {
+		value := current.value
+		if value == nil && t.loader != nil {
+			value, _ = t.loader(current.key)
+		}
+
+		action(current.key, value)
+
+		for _, duplicate := range current.duplicates {
+			action(current.key, duplicate)
+		}
+	}
+}
+
+// ForEachKey traverses tree in ascending key order and passes only
+// the keys, once per key, without loading the values of a tree created
+// with NewWithValueLoader. Keys must not be modified.
+func (t *Tree) ForEachKey(action func(key []byte)) {
+	t.traverse(func(n *node) {
+		action(n.key)
+	})
+}
+
+// ForEachWithKeyLen traverses tree in ascending key order and passes
+// only the entries with keys of exactly n bytes. The keys of the same
+// length are not contiguous in the key order, so it scans the whole
+// tree in O(n) time, but loads only the values of the passed entries.
+func (t *Tree) ForEachWithKeyLen(n int, action func(key, value []byte)) {
+	for current := live(t.leftmost); current != nil; current = live(successor(current)) {
+		if len(current.key) != n {
+			continue
+		}
+
+		value := current.value
+		if value == nil && t.loader != nil {
+			value, _ = t.loader(current.key)
+		}
+
+		action(current.key, value)
+
+		for _, duplicate := range current.duplicates {
+			action(current.key, duplicate)
+		}
+	}
+}
+
+// ForEachIndexed traverses tree in ascending key order and passes
+// the zero-based position of each entry along with it.
+func (t *Tree) ForEachIndexed(action func(index int, key, value []byte)) {
+	index := 0
+	t.ForEach(func(key, value []byte) {
+		action(index, key, value)
+		index++
+	})
+}
+
+// ForEachWithProgress traverses tree in ascending key order and passes
+// the zero-based position of each entry and the total number of entries
+// captured before the traversal, which is Size for an ordinary tree and
+// the number of all the values for a multi tree.
+func (t *Tree) ForEachWithProgress(action func(index, total int, key, value []byte)) {
+	total := t.Size()
+	if t.multi {
+		t.traverse(func(n *node) {
+			total += len(n.duplicates)
+		})
+	}
+
+	index := 0
+	t.ForEach(func(key, value []byte) {
+		action(index, total, key, value)
+		index++
+	})
+}
+
+// ForEachMutable traverses tree in ascending key order and passes
+// a pointer to the stored value, so that the action can replace it
+// in place, including with a slice of a different length.
+// Caution! Keys must not be modified, otherwise the order of the tree
+// is violated.
+func (t *Tree) ForEachMutable(action func(key []byte, value *[]byte)) {
+	if t.root == nil {
+		return
+	}
+
+	for current := live(minimum(t.root)); current != nil; current = live(successor(current)) {
+		if t.valueIndex == nil {
+			action(current.key, &current.value)
+			continue
+		}
+
+		t.unindexValue(current.key, current.value)
+		action(current.key, &current.value)
+		t.indexValue(current.key, current.value)
+	}
+}
+
+// TransformValues replaces the value of each entry with the result
+// of fn in a single traversal in ascending key order.
+// If fn returns nil, an empty value is stored.
+func (t *Tree) TransformValues(fn func(key, value []byte) []byte) {
+	t.ForEachMutable(func(key []byte, value *[]byte) {
+		transformed := fn(key, *value)
+		if transformed == nil {
+			transformed = []byte{}
+		}
+
+		*value = transformed
+	})
+}
+
+// Entries returns copies of all the entries in ascending key order.
+func (t *Tree) Entries() []Entry {
+	entries := make([]Entry, 0, t.size)
+	t.ForEach(func(key, value []byte) {
+		entries = append(entries, Entry{copyBytes(key), copyBytes(value)})
+	})
+
+	return entries
+}
+
+// ToMap returns a map holding all the entries of the tree
+// with copied values. For a multi tree, only the first value
+// of each key is kept.
+func (t *Tree) ToMap() map[string][]byte {
+	m := make(map[string][]byte, t.size)
+	t.ForEach(func(key, value []byte) {
+		if _, ok := m[string(key)]; !ok {
+			m[string(key)] = copyBytes(value)
+		}
+	})
+
+	return m
+}
+
+// ColorCounts returns the numbers of red and black nodes in the tree.
+func (t *Tree) ColorCounts() (reds, blacks int) {
+	for current := t.leftmost; current != nil; current = successor(current) {
+		if current.color == black {
+			blacks++
+		} else {
+			reds++
+		}
+	}
+
+	return reds, blacks
+}
+
+// ForEachLevel traverses tree breadth-first, level by level from
+// the root and from left to right within a level, and passes the level
+// of each node, the number of edges from the root, along with the key,
+// the first value and the color. It is meant for debugging and
+// visualization and does not modify the tree.
+func (t *Tree) ForEachLevel(action func(level int, key, value []byte, isBlack bool)) {
+	if t.root == nil {
+		return
+	}
+
+	level := 0
+	queue := []*node{t.root}
+	for len(queue) > 0 {
+		next := make([]*node, 0, 2*len(queue))
+		for _, n := range queue {
+			action(level, n.key, n.value, n.color == black)
+
+			if n.left != nil {
+				next = append(next, n.left)
+			}
+			if n.right != nil {
+				next = append(next, n.right)
+			}
+		}
+
+		queue = next
+		level++
+	}
+}
+
+// ForEachNode traverses tree in ascending key order and passes the color
+// of each node and its depth, the number of edges from the root,
+// along with the key and the first value. It is meant for debugging
+// and visualization and does not modify the tree.
+func (t *Tree) ForEachNode(action func(key, value []byte, isBlack bool, depth int)) {
+	type frame struct {
+		node  *node
+		depth int
+	}
+
+	stack := make([]frame, 0)
+
+	current, depth := t.root, 0
+	for current != nil || len(stack) > 0 {
+		for current != nil {
+			stack = append(stack, frame{current, depth})
+			current = current.left
+			depth++
+		}
+
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		action(top.node.key, top.node.value, top.node.color == black, top.depth)
+
+		current, depth = top.node.right, top.depth+1
+	}
+}
+
+// RangeLimit traverses at most limit entries with keys greater than
+// or equal to start in ascending key order and returns the number
+// of visited entries. Each value of a key of a multi tree counts
+// as an entry.
+func (t *Tree) RangeLimit(start []byte, limit int, action func(key, value []byte)) int {
+	if limit <= 0 {
+		return 0
+	}
+
+	visited := 0
+	for current := live(t.ceiling(start)); current != nil; current = live(successor(current)) {
+		action(current.key, current.value)
+
+		visited++
+		if visited == limit {
+			break
+		}
+
+		for _, duplicate := range current.duplicates {
+			action(current.key, duplicate)
+
+			visited++
+			if visited == limit {
+				return visited
+			}
+		}
+	}
+
+	return visited
+}
+
+// Window returns copies of at most before entries with keys less than
+// pivot and at most after entries with keys greater than or equal to
+// pivot, which are the closest to pivot, in ascending key order.
+// A multi tree returns one entry per key with the first value.
+func (t *Tree) Window(pivot []byte, before, after int) []Entry {
+	preceding := make([]*node, 0)
+	for current := t.lower(pivot); current != nil && len(preceding) < before; current = predecessor(current) {
+		if !current.deleted {
+			preceding = append(preceding, current)
+		}
+	}
+
+	window := make([]Entry, 0, len(preceding))
+	for i := len(preceding) - 1; i >= 0; i-- {
+		window = append(window, Entry{copyBytes(preceding[i].key), copyBytes(preceding[i].value)})
+	}
+
+	following := 0
+	for current := live(t.ceiling(pivot)); current != nil && following < after; current = live(successor(current)) {
+		window = append(window, Entry{copyBytes(current.key), copyBytes(current.value)})
+		following++
+	}
+
+	return window
+}
+
+// MultiRange traverses in ascending key order the entries with keys in
+// any of the ranges [Lo, Hi), visiting each entry once even if
+// the ranges overlap. Nil Lo or Hi means that the range is unbounded
+// on that side.
+func (t *Tree) MultiRange(ranges []struct{ Lo, Hi []byte }, action func(key, value []byte)) {
+	sorted := make([]struct{ Lo, Hi []byte }, len(ranges))
+	copy(sorted, ranges)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].Lo, sorted[j].Lo) < 0
+	})
+
+	var last []byte
+	for _, r := range sorted {
+		// the ranges are sorted by the lower bound, so the entries
+		// up to the last visited one are already visited and the range
+		// continues from the least key greater than the last one
+		lo := r.Lo
+		if last != nil && bytes.Compare(lo, last) <= 0 {
+			lo = append(copyBytes(last), 0)
+		}
+
+		t.rangeNodes(lo, r.Hi, func(n *node) bool {
+			action(n.key, n.value)
+			for _, duplicate := range n.duplicates {
+				action(n.key, duplicate)
+			}
+
+			last = n.key
+			return true
+		})
+	}
+}
+
+// SumRange returns the sum of the values decoded by decode for all
+// the entries with keys in the range [lo, hi). Nil lo or hi means that
+// the range is unbounded on that side.
+func (t *Tree) SumRange(lo, hi []byte, decode func(value []byte) int64) int64 {
+	var sum int64
+	t.rangeNodes(lo, hi, func(n *node) bool {
+		sum += decode(n.value)
+		for _, duplicate := range n.duplicates {
+			sum += decode(duplicate)
+		}
+
+		return true
+	})
+
+	return sum
+}
+
+// Page returns copies of at most limit entries with keys strictly greater
+// than after in ascending key order, or from the least key if after is
+// nil, and the key to pass as after to get the next page, or nil if there
+// are no more entries. A multi tree returns one entry per key with
+// the first value.
+func (t *Tree) Page(after []byte, limit int) (entries []Entry, next []byte) {
+	if limit <= 0 {
+		return nil, nil
+	}
+
+	var current *node
+	if after == nil {
+		current = live(t.leftmost)
+	} else {
+		current = live(t.higher(after))
+	}
+
+	for ; current != nil && len(entries) < limit; current = live(successor(current)) {
+		entries = append(entries, Entry{copyBytes(current.key), copyBytes(current.value)})
+	}
+
+	if current != nil {
+		next = copyBytes(entries[len(entries)-1].Key)
+	}
+
+	return entries, next
+}
+
+// RangeReverse traverses the entries with keys in the range [lo, hi)
+// in descending key order. Nil lo or hi means that the range is
+// unbounded on that side. The values of a key of a multi tree
+// are still traversed in insertion order.
+func (t *Tree) RangeReverse(lo, hi []byte, action func(key, value []byte)) {
+	if t.root == nil {
+		return
+	}
+
+	var current *node
+	if hi == nil {
+		current = liveBefore(t.rightmost)
+	} else {
+		current = liveBefore(t.lower(hi))
+	}
+
+	for ; current != nil; current = liveBefore(predecessor(current)) {
+		if lo != nil && bytes.Compare(current.key, lo) < 0 {
+			return
+		}
+
+		action(current.key, current.value)
+		for _, duplicate := range current.duplicates {
+			action(current.key, duplicate)
+		}
+	}
+}
+
+// IndexOf returns the zero-based position of the key in ascending key
+// order and true, or 0 and false if the key is not in the tree.
+func (t *Tree) IndexOf(key []byte) (int, bool) {
+	found := t.getNode(key)
+	if found == nil {
+		return 0, false
+	}
+
+	return t.liveRank(found), true
+}
+
+// FloorIndex returns the zero-based position in ascending key order of
+// the entry with the greatest key less than or equal to the given key
+// and true, or 0 and false if there is no such entry.
+func (t *Tree) FloorIndex(key []byte) (int, bool) {
+	found := liveBefore(t.floor(key))
+	if found == nil {
+		return 0, false
+	}
+
+	return t.liveRank(found), true
+}
+
+// CeilingIndex returns the zero-based position in ascending key order of
+// the entry with the least key greater than or equal to the given key
+// and true, or 0 and false if there is no such entry.
+func (t *Tree) CeilingIndex(key []byte) (int, bool) {
+	found := live(t.ceiling(key))
+	if found == nil {
+		return 0, false
+	}
+
+	return t.liveRank(found), true
+}
+
+// Path returns copies of the keys on the path from the node holding
+// the key up to and including the root, or nil if the key is not found.
+func (t *Tree) Path(key []byte) [][]byte {
+	found := t.getNode(key)
+	if found == nil {
+		return nil
+	}
+
+	path := make([][]byte, 0)
+	for current := found; current != nil; current = current.parent {
+		path = append(path, copyBytes(current.key))
+	}
+
+	return path
+}
+
+// LongestPrefixMatch returns a copy of the longest key in the tree that
+// is a prefix of the query, the associated value and true, or nil, nil
+// and false if no key is a prefix of the query.
+func (t *Tree) LongestPrefixMatch(query []byte) ([]byte, []byte, bool) {
+	bound := query
+	for {
+		// all the keys that are prefixes of the query and longer than
+		// the common prefix of the bound and its floor are greater than
+		// the floor and not greater than the bound, so they do not exist
+		candidate := liveBefore(t.floor(bound))
+		if candidate == nil {
+			return nil, nil, false
+		}
+
+		if bytes.HasPrefix(query, candidate.key) {
+			return copyBytes(candidate.key), candidate.value, true
+		}
+
+		bound = bound[:commonPrefixLength(bound, candidate.key)]
+	}
+}
+
+// ClosestUint64 treats the keys as big-endian uint64 numbers and returns
+// a copy of the key numerically closest to the target, the associated
+// value and true, or nil, nil and false if the tree is empty.
+// Of two equally close keys, it returns the lesser one.
+// All the keys of the tree must be 8 bytes long.
+func (t *Tree) ClosestUint64(target uint64) (key, value []byte, found bool) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], target)
+
+	closest := liveBefore(t.floor(buf[:]))
+	if ceiling := live(t.ceiling(buf[:])); ceiling != nil {
+		if closest == nil || binary.BigEndian.Uint64(ceiling.key)-target < target-binary.BigEndian.Uint64(closest.key) {
+			closest = ceiling
+		}
+	}
+
+	if closest == nil {
+		return nil, nil, false
+	}
+
+	return copyBytes(closest.key), closest.value, true
+}
+
+// Depth returns the number of edges from the root to the node holding
+// the key and true if found, otherwise 0 and false.
+func (t *Tree) Depth(key []byte) (int, bool) {
+	depth := 0
+
+	current := t.root
+	for current != nil {
+		cmp := bytes.Compare(key, current.key)
+		if cmp < 0 {
+			current = current.left
+		} else if cmp > 0 {
+			current = current.right
+		} else if current.deleted {
+			return 0, false
+		} else {
+			return depth, true
+		}
+
+		depth++
+	}
+
+	return 0, false
+}
+
+// WithinHamming traverses in ascending key order the entries with keys
+// of the same length as the target that differ from it in at most d
+// positions. It skips the ranges of keys sharing a prefix that already
+// differs in more than d positions or is longer than the target, but
+// it still takes O(n) time in the worst case.
+func (t *Tree) WithinHamming(target []byte, d int, action func(key, value []byte)) {
+	if d < 0 {
+		return
+	}
+
+	current := live(t.leftmost)
+	for current != nil {
+		key := current.key
+
+		mismatches, i := 0, 0
+		for ; i < len(key) && i < len(target); i++ {
+			if key[i] != target[i] {
+				mismatches++
+				if mismatches > d {
+					break
+				}
+			}
+		}
+
+		// the keys sharing the prefix up to the mismatch exceeding d,
+		// or the prefix of the target length of a longer key, follow
+		// the key and cannot match either
+		var skip []byte
+		if mismatches > d {
+			skip = key[:i+1]
+		} else if len(key) > len(target) {
+			skip = key[:len(target)]
+		}
+
+		if skip != nil {
+			end := PrefixEnd(skip)
+			if end == nil {
+				return
+			}
+
+			current = live(t.ceiling(end))
+			continue
+		}
+
+		if len(key) == len(target) {
+			action(key, current.value)
+			for _, duplicate := range current.duplicates {
+				action(key, duplicate)
+			}
+		}
+
+		current = live(successor(current))
+	}
+}
+
+// PathLengths returns the numbers of nodes on the shortest and
+// the longest paths from the root to a missing child, which for
+// a valid tree satisfy max <= 2*min. Both are 0 for an empty tree.
+func (t *Tree) PathLengths() (min, max int) {
+	return pathLengths(t.root)
+}
+
+func pathLengths(n *node) (min, max int) {
+	if n == nil {
+		return 0, 0
+	}
+
+	leftMin, leftMax := pathLengths(n.left)
+	rightMin, rightMax := pathLengths(n.right)
+
+	min, max = leftMin, leftMax
+	if rightMin < min {
+		min = rightMin
+	}
+	if rightMax > max {
+		max = rightMax
+	}
+
+	return min + 1, max + 1
+}
+
+// CountByPrefixes returns the number of keys starting with each of
+// the prefixes, in the order of the prefixes.
+func (t *Tree) CountByPrefixes(prefixes [][]byte) []int {
+	counts := make([]int, len(prefixes))
+	for i, prefix := range prefixes {
+		current := live(t.ceiling(prefix))
+		for current != nil && bytes.HasPrefix(current.key, prefix) {
+			counts[i]++
+			current = live(successor(current))
+		}
+	}
+
+	return counts
+}
+
+// Filter returns a new tree holding copies of the entries
+// for which pred returns true. The tree itself is not modified.
+func (t *Tree) Filter(pred func(key, value []byte) bool) *Tree {
+	entries := make([]Entry, 0)
+	t.traverse(func(n *node) {
+		if pred(n.key, n.value) {
+			entries = append(entries, Entry{copyBytes(n.key), copyBytes(n.value)})
+		}
+	})
+
+	filtered := New()
+	filtered.setRoot(buildFromSorted(entries))
+
+	return filtered
+}
+
+// MapValues returns a new tree with the same keys and the values
+// replaced with copies of the results of fn. The tree itself is not modified.
+func (t *Tree) MapValues(fn func(key, value []byte) []byte) *Tree {
+	entries := make([]Entry, 0, t.size)
+	t.traverse(func(n *node) {
+		entries = append(entries, Entry{copyBytes(n.key), copyBytes(fn(n.key, n.value))})
+	})
+
+	mapped := New()
+	mapped.setRoot(buildFromSorted(entries))
+
+	return mapped
+}
+
+// SingleByteBitmap returns the bitmap of the single-byte keys in the tree,
+// where key k is present if bit k%8 of byte k/8 is set, and true.
+// It returns false as soon as it finds a key that is not exactly
+// one byte long.
+func (t *Tree) SingleByteBitmap() ([32]byte, bool) {
+	var bitmap [32]byte
+	for current := live(t.leftmost); current != nil; current = live(successor(current)) {
+		if len(current.key) != 1 {
+			return [32]byte{}, false
+		}
+
+		k := current.key[0]
+		bitmap[k/8] |= 1 << (k % 8)
+	}
+
+	return bitmap, true
+}
+
+// Median returns a copy of the key at the middle position in ascending
+// key order, the associated value and true, or nil, nil and false if
+// the tree is empty. For an even size, it returns the lower of the two
+// middle keys. It takes O(log n) time, or O(n) if the tree holds
+// tombstones.
+func (t *Tree) Median() ([]byte, []byte, bool) {
+	if t.Size() == 0 {
+		return nil, nil, false
+	}
+
+	median := t.selectLive((t.Size() - 1) / 2)
+
+	return copyBytes(median.key), median.value, true
+}
+
+// MaxBy returns a copy of the key with the greatest value under less,
+// the value and true, or nil, nil and false if the tree is empty.
+// Of the equal values the first in ascending key order wins. It takes
+// O(n) time.
+func (t *Tree) MaxBy(less func(a, b []byte) bool) ([]byte, []byte, bool) {
+	return t.bestBy(func(candidate, best []byte) bool {
+		return less(best, candidate)
+	})
+}
+
+// MinBy returns a copy of the key with the least value under less,
+// the value and true, or nil, nil and false if the tree is empty.
+// Of the equal values the first in ascending key order wins. It takes
+// O(n) time.
+func (t *Tree) MinBy(less func(a, b []byte) bool) ([]byte, []byte, bool) {
+	return t.bestBy(less)
+}
+
+// bestBy returns the first entry with the best value, where better
+// reports whether the candidate value beats the best one so far.
+func (t *Tree) bestBy(better func(candidate, best []byte) bool) ([]byte, []byte, bool) {
+	var bestKey, bestValue []byte
+	found := false
+	t.ForEach(func(key, value []byte) {
+		if !found || better(value, bestValue) {
+			bestKey, bestValue, found = key, value, true
+		}
+	})
+
+	if !found {
+		return nil, nil, false
+	}
+
+	return copyBytes(bestKey), bestValue, true
+}
+
+// Quantile returns a copy of the key at the position round(q*(size-1))
+// in ascending key order, the associated value and true, or nil, nil
+// and false if the tree is empty or q is NaN. The q outside of [0, 1]
+// is clamped to it. It takes O(log n) time, or O(n) if the tree holds
+// tombstones.
+func (t *Tree) Quantile(q float64) ([]byte, []byte, bool) {
+	if t.Size() == 0 || math.IsNaN(q) {
+		return nil, nil, false
+	}
+
+	q = math.Max(0, math.Min(1, q))
+	found := t.selectLive(int(math.Round(q * float64(t.Size()-1))))
+
+	return copyBytes(found.key), found.value, true
+}
+
+// SplitPoints returns copies of the keys that split the tree into n ranges
+// of roughly equal size, each key starting a range after the first one.
+// It returns fewer keys, possibly none, if the tree has fewer than n entries,
+// so that no range is empty.
+func (t *Tree) SplitPoints(n int) [][]byte {
+	points := make([][]byte, 0)
+
+	prev := 0
+	for i := 1; i < n; i++ {
+		position := i * t.Size() / n
+		if position == prev {
+			continue
+		}
+
+		points = append(points, copyBytes(t.selectLive(position).key))
+		prev = position
+	}
+
+	return points
+}
+
+// OnChange registers the observer that is called after each successful
+// mutation of the tree with the affected key and the new value,
+// or the removed value for OpDelete.
+// Only one observer is supported, registering a new one replaces
+// the previous one, nil unregisters it.
+func (t *Tree) OnChange(fn func(op Op, key, value []byte)) {
+	t.onChange = fn
+}
+
+func (t *Tree) notify(op Op, key, value []byte) {
+	if t.onChange != nil {
+		t.onChange(op, key, value)
+	}
+}
+
+// Rebuild replaces the nodes of the tree with a freshly built, perfectly
+// balanced red-black tree holding the same entries, so that the old
+// nodes can be reclaimed by GC.
+func (t *Tree) Rebuild() {
+	nodes := make([]*node, 0, t.size)
+	t.traverse(func(n *node) {
+		nodes = append(nodes, n)
+	})
+
+	t.rebuildFrom(nodes)
+}
+
+// EnsureBalanced rebuilds the tree if its height exceeds
+// factor*log2(size+1) and returns true if it has been rebuilt.
+// A valid red-black tree never exceeds the factor of 2, so the rebuild
+// is only a safety net that signals a defect.
+func (t *Tree) EnsureBalanced(factor float64) bool {
+	if t.root == nil {
+		return false
+	}
+
+	_, height := t.PathLengths()
+	if float64(height) <= factor*math.Log2(float64(t.size+1)) {
+		return false
+	}
+
+	t.Rebuild()
+
+	return true
+}
+
+// ReplaceAll replaces all the entries of the tree with the pairs,
+// which must be strictly sorted, see IsStrictlySorted, building
+// the balanced tree in O(n) time. Otherwise it returns an error and
+// leaves the tree unchanged.
+func (t *Tree) ReplaceAll(pairs []Entry) error {
+	if !IsStrictlySorted(pairs) {
+		return errors.New("pairs are not strictly sorted")
+	}
+
+	entries := make([]Entry, len(pairs))
+	for i, pair := range pairs {
+		entries[i] = Entry{copyBytes(pair.Key), pair.Value}
+	}
+
+	dropped := make([]Entry, 0)
+	if t.onChange != nil {
+		t.traverse(func(n *node) {
+			dropped = append(dropped, Entry{n.key, n.value})
+		})
+	}
+
+	t.setRoot(buildFromSorted(entries))
+	t.resetOrder()
+
+	for _, entry := range dropped {
+		t.notify(OpDelete, entry.Key, entry.Value)
+	}
+	for _, entry := range entries {
+		t.notify(OpInsert, entry.Key, entry.Value)
+	}
+
+	return nil
+}
+
+// Retain removes all the entries with keys outside of the range [lo, hi)
+// and returns the number of removed entries. Nil lo or hi means that
+// the range is unbounded on that side.
+// The tree is rebuilt from the retained entries.
+func (t *Tree) Retain(lo, hi []byte) int {
+	retained := make([]*node, 0)
+	t.rangeNodes(lo, hi, func(n *node) bool {
+		retained = append(retained, n)
+		return true
+	})
+
+	removed := t.Size() - len(retained)
+	if removed == 0 {
+		return 0
+	}
+
+	dropped := make([]Entry, 0)
+	if t.onChange != nil {
+		t.traverse(func(n *node) {
+			if (lo != nil && bytes.Compare(n.key, lo) < 0) || (hi != nil && bytes.Compare(n.key, hi) >= 0) {
+				dropped = append(dropped, Entry{n.key, n.value})
+			}
+		})
+	}
+
+	t.rebuildFrom(retained)
+
+	for _, entry := range dropped {
+		t.notify(OpDelete, entry.Key, entry.Value)
+	}
+
+	return removed
+}
+
+// rebuildFrom replaces the content of the tree with a freshly built,
+// perfectly balanced tree holding the entries of the nodes
+// in strictly ascending key order.
+func (t *Tree) rebuildFrom(nodes []*node) {
+	entries := make([]Entry, len(nodes))
+	for i, n := range nodes {
+		entries[i] = Entry{n.key, n.value}
+	}
+
+	root := buildFromSorted(entries)
+
+	// the duplicates are moved before the root is set,
+	// so that the indexes rebuilt by setRoot see them
+	rebuilt := make([]*node, 0, len(nodes))
+	if root != nil {
+		for n := minimum(root); n != nil; n = successor(n) {
+			n.duplicates = nodes[len(rebuilt)].duplicates
+			rebuilt = append(rebuilt, n)
+		}
+	}
+
+	oldest := t.oldest
+	t.setRoot(root)
+	t.relinkOrder(oldest, nodes, rebuilt)
+}
+
+// Compact copies each value whose slice has spare capacity into
+// a slice of the exact length, so that the memory held by the spare
+// capacity can be reclaimed by GC. Keys, values and the structure
+// of the tree remain unchanged.
+func (t *Tree) Compact() {
+	t.traverse(func(n *node) {
+		n.value = shrink(n.value)
+		for i, duplicate := range n.duplicates {
+			n.duplicates[i] = shrink(duplicate)
+		}
+	})
+}
+
+// shrink returns a copy of the slice with the capacity equal to its
+// length, or the slice itself if it has no spare capacity.
+func shrink(s []byte) []byte {
+	if cap(s) == len(s) {
+		return s
+	}
+
+	return copyBytes(s)
+}
+
+// traverse traverses the nodes of the tree in ascending key order.
+func (t *Tree) traverse(action func(n *node)) {
+	if t.root == nil {
+		return
+	}
+
+	for current := live(minimum(t.root)); current != nil; current = live(successor(current)) {
+		action(current)
+	}
+}
+
+// Swap exchanges the contents of the tree and the other tree in O(1),
+// or in O(n) if any of them maintains a membership or a value index,
+// which is rebuilt. The settings of the trees, like the observers registered
+// with OnChange, are not exchanged, so a tree created with
+// NewWithInsertionOrder receives the contents of a tree that does not
+// track the order in ascending key order.
+func (t *Tree) Swap(other *Tree) {
+	t.root, other.root = other.root, t.root
+	t.size, other.size = other.size, t.size
+	t.tombstones, other.tombstones = other.tombstones, t.tombstones
+	t.leftmost, other.leftmost = other.leftmost, t.leftmost
+	t.rightmost, other.rightmost = other.rightmost, t.rightmost
+	t.oldest, other.oldest = other.oldest, t.oldest
+	t.newest, other.newest = other.newest, t.newest
+	if t.ordered != other.ordered {
+		t.resetOrder()
+		other.resetOrder()
+	}
+
+	t.version++
+	other.version++
+
+	t.resetMembers()
+	other.resetMembers()
+	t.resetValueIndex()
+	other.resetValueIndex()
+
+	if t.debug {
+		t.check("Swap")
+	}
+	if other.debug {
+		other.check("Swap")
+	}
+}
+
+// setRoot replaces the content of the tree with the tree rooted at root.
+func (t *Tree) setRoot(root *node) {
+	t.root = root
+	t.size = sizeOf(root)
+	t.tombstones = 0
+	t.version++
+
+	t.leftmost, t.rightmost = nil, nil
+	if root != nil {
+		t.leftmost, t.rightmost = minimum(root), maximum(root)
+	}
+
+	t.resetMembers()
+	t.resetValueIndex()
+	t.oldest, t.newest = nil, nil
+
+	if t.debug {
+		t.check("rebuild")
+	}
+}
+
+// buildFromSorted builds a balanced red-black tree from the entries
+// in strictly ascending key order in linear time.
+// All nodes are black except the ones at the deepest level if it is not full.
+func buildFromSorted(entries []Entry) *node {
+	return buildSubtree(entries, 0, len(entries)-1, 0, redLevel(len(entries)), nil)
+}
+
+func buildSubtree(entries []Entry, lo, hi, level, redLevel int, parent *node) *node {
+	if lo > hi {
+		return nil
 	}
 
-	if cmp < 0 {
-		parent.left = newNode
-	} else {
-		parent.right = newNode
+	mid := (lo + hi) / 2
+	n := &node{entries[mid].Key, entries[mid].Value, parent, nil, nil, black, hi - lo + 1, nil, false, nil, nil}
+	if level == redLevel {
+		n.color = red
 	}
-	newNode.parent = parent
 
-	t.fixAfterInsertion(newNode)
+	n.left = buildSubtree(entries, lo, mid-1, level+1, redLevel, n)
+	n.right = buildSubtree(entries, mid+1, hi, level+1, redLevel, n)
 
-	t.size++
+	return n
+}
 
-	return nil, false
+// linkSorted links the nodes in strictly ascending key order into
+// a balanced red-black tree in linear time like buildFromSorted,
+// reusing the nodes instead of allocating new ones.
+func linkSorted(nodes []*node) *node {
+	return linkSubtree(nodes, 0, len(nodes)-1, 0, redLevel(len(nodes)), nil)
 }
 
-// Get searches the key and returns the associated value and true if found,
-// otherwise nil and false.
-func (t *Tree) Get(key []byte) ([]byte, bool) {
-	if t.root == nil {
-		return nil, false
+func linkSubtree(nodes []*node, lo, hi, level, redLevel int, parent *node) *node {
+	if lo > hi {
+		return nil
 	}
 
-	current := t.root
-	for current != nil {
-		cmp := bytes.Compare(key, current.key)
-		if cmp < 0 {
-			current = current.left
-		} else if cmp > 0 {
-			current = current.right
-		} else {
-			return current.value, true
-		}
+	mid := (lo + hi) / 2
+	n := nodes[mid]
+	n.parent, n.color, n.size = parent, black, hi-lo+1
+	if level == redLevel {
+		n.color = red
 	}
 
-	return nil, false
+	n.left = linkSubtree(nodes, lo, mid-1, level+1, redLevel, n)
+	n.right = linkSubtree(nodes, mid+1, hi, level+1, redLevel, n)
+
+	return n
 }
 
-// ForEach traverses tree in ascending key order.
-func (t *Tree) ForEach(action func(key []byte, value []byte)) {
-	for it := t.Iterator(); it.HasNext(); {
-		key, value := it.Next()
-		action(key, value)
+// redLevel returns the level at which the nodes must be red for
+// the tree of the given size built by buildFromSorted.
+func redLevel(size int) int {
+	level := 0
+	for m := size - 1; m >= 0; m = m/2 - 1 {
+		level++
 	}
+
+	return level
 }
 
 // fixAfterInsertion fixes the tree to satisfy the red-black tree
-// properties of the tree.
-func (t *Tree) fixAfterInsertion(newNode *node) {
+// properties of the tree and returns the number of rotations.
+func (t *Tree) fixAfterInsertion(newNode *node) int {
+	rotations := 0
 	current := newNode
 
 	for current != t.root && current.parent.color == red {
@@ -136,12 +1940,14 @@ func (t *Tree) fixAfterInsertion(newNode *node) {
 					current = current.parent
 
 					t.rotateLeft(current)
+					rotations++
 				}
 
 				current.parent.color = black
 				current.parent.parent.color = red
 
 				t.rotateRight(current.parent.parent)
+				rotations++
 			}
 		} else if current.parent.parent.right == current.parent {
 			uncle := current.parent.parent.left
@@ -155,17 +1961,228 @@ func (t *Tree) fixAfterInsertion(newNode *node) {
 					current = current.parent
 
 					t.rotateRight(current)
+					rotations++
 				}
 
 				current.parent.color = black
 				current.parent.parent.color = red
 
 				t.rotateLeft(current.parent.parent)
+				rotations++
 			}
 		}
 	}
 
 	t.root.color = black
+
+	return rotations
+}
+
+// deleteNode unlinks the node from the tree and notifies the observer.
+func (t *Tree) deleteNode(z *node) {
+	t.unlink(z)
+
+	t.notify(OpDelete, z.key, z.value)
+}
+
+// unlink removes the node from the tree and fixes the tree to satisfy
+// the red-black tree properties. The detached node keeps its key,
+// value and duplicates.
+func (t *Tree) unlink(z *node) {
+	// the node that is actually removed from its position
+	// in the tree, either z or its successor that takes z's place
+	y := z
+	if z.left != nil && z.right != nil {
+		y = minimum(z.right)
+	}
+	removedColor := y.color
+
+	if z == t.leftmost {
+		t.leftmost = successor(z)
+	}
+	if z == t.rightmost {
+		t.rightmost = predecessor(z)
+	}
+
+	for current := y.parent; current != nil; current = current.parent {
+		current.size--
+	}
+
+	// x takes the place of y, and might be nil,
+	// so its parent is tracked separately
+	var x, xParent *node
+	if z.left == nil {
+		x = z.right
+		xParent = z.parent
+		t.transplant(z, z.right)
+	} else if z.right == nil {
+		x = z.left
+		xParent = z.parent
+		t.transplant(z, z.left)
+	} else {
+		x = y.right
+
+		if y.parent == z {
+			xParent = y
+		} else {
+			xParent = y.parent
+			t.transplant(y, y.right)
+			y.right = z.right
+			y.right.parent = y
+		}
+
+		t.transplant(z, y)
+		y.left = z.left
+		y.left.parent = y
+		y.color = z.color
+		y.size = z.size
+	}
+
+	if removedColor == black {
+		rotations := t.fixAfterDeletion(x, xParent)
+		if t.stats != nil {
+			atomic.AddInt64(&t.stats.deleteFixups, 1)
+			atomic.AddInt64(&t.stats.deleteRotations, int64(rotations))
+		}
+	}
+
+	z.parent, z.left, z.right = nil, nil, nil
+	if z.deleted {
+		t.tombstones--
+	}
+	t.removeMember(z.key)
+	t.unindexNode(z)
+	if !z.deleted {
+		t.removeOrder(z)
+	}
+
+	t.size--
+	t.version++
+
+	if t.debug {
+		t.check("deletion")
+	}
+}
+
+// fixAfterDeletion fixes the tree to satisfy the red-black tree
+// properties after a black node has been removed and x, which may be
+// nil, has taken its place under the parent. It returns the number
+// of rotations.
+func (t *Tree) fixAfterDeletion(x *node, parent *node) int {
+	rotations := 0
+	for x != t.root && colorOf(x) == black {
+		if x == parent.left {
+			sibling := parent.right
+			if sibling.color == red {
+				sibling.color = black
+				parent.color = red
+
+				t.rotateLeft(parent)
+				rotations++
+				sibling = parent.right
+			}
+
+			if colorOf(sibling.left) == black && colorOf(sibling.right) == black {
+				sibling.color = red
+
+				x = parent
+				parent = x.parent
+			} else {
+				if colorOf(sibling.right) == black {
+					sibling.left.color = black
+					sibling.color = red
+
+					t.rotateRight(sibling)
+					rotations++
+					sibling = parent.right
+				}
+
+				sibling.color = parent.color
+				parent.color = black
+				sibling.right.color = black
+
+				t.rotateLeft(parent)
+				rotations++
+
+				x = t.root
+			}
+		} else {
+			sibling := parent.left
+			if sibling.color == red {
+				sibling.color = black
+				parent.color = red
+
+				t.rotateRight(parent)
+				rotations++
+				sibling = parent.left
+			}
+
+			if colorOf(sibling.left) == black && colorOf(sibling.right) == black {
+				sibling.color = red
+
+				x = parent
+				parent = x.parent
+			} else {
+				if colorOf(sibling.left) == black {
+					sibling.right.color = black
+					sibling.color = red
+
+					t.rotateLeft(sibling)
+					rotations++
+					sibling = parent.left
+				}
+
+				sibling.color = parent.color
+				parent.color = black
+				sibling.left.color = black
+
+				t.rotateRight(parent)
+				rotations++
+
+				x = t.root
+			}
+		}
+	}
+
+	if x != nil {
+		x.color = black
+	}
+
+	return rotations
+}
+
+// transplant replaces the subtree rooted at u with the subtree rooted at v.
+func (t *Tree) transplant(u, v *node) {
+	if u.parent == nil {
+		t.root = v
+	} else if u == u.parent.left {
+		u.parent.left = v
+	} else {
+		u.parent.right = v
+	}
+
+	if v != nil {
+		v.parent = u.parent
+	}
+}
+
+// sizeOf returns the size of the subtree rooted at the node,
+// nil nodes are empty.
+func sizeOf(n *node) int {
+	if n == nil {
+		return 0
+	}
+
+	return n.size
+}
+
+// colorOf returns the color of the node, nil nodes are black.
+func colorOf(n *node) color {
+	if n == nil {
+		return black
+	}
+
+	return n.color
 }
 
 func (t *Tree) rotateLeft(node *node) {
@@ -187,6 +2204,9 @@ func (t *Tree) rotateLeft(node *node) {
 
 	nodeRight.left = node
 	node.parent = nodeRight
+
+	nodeRight.size = node.size
+	node.size = sizeOf(node.left) + sizeOf(node.right) + 1
 }
 
 func (t *Tree) rotateRight(node *node) {
@@ -208,11 +2228,341 @@ func (t *Tree) rotateRight(node *node) {
 
 	nodeLeft.right = node
 	node.parent = nodeLeft
+
+	nodeLeft.size = node.size
+	node.size = sizeOf(node.left) + sizeOf(node.right) + 1
+}
+
+// getNode returns the node holding the key, or nil if there is no such node.
+func (t *Tree) getNode(key []byte) *node {
+	comparisons := 0
+
+	current := t.root
+	for current != nil {
+		comparisons++
+
+		cmp := bytes.Compare(key, current.key)
+		if cmp < 0 {
+			current = current.left
+		} else if cmp > 0 {
+			current = current.right
+		} else {
+			break
+		}
+	}
+
+	if t.stats != nil {
+		atomic.AddInt64(&t.stats.comparisons, int64(comparisons))
+	}
+
+	if current != nil && current.deleted {
+		return nil
+	}
+
+	return current
+}
+
+// rangeNodes calls visit for the live nodes with keys in the range
+// [lo, hi) in ascending key order until visit returns false.
+// Nil lo or hi means that the range is unbounded on that side.
+func (t *Tree) rangeNodes(lo, hi []byte, visit func(n *node) bool) {
+	first, end := t.rangeBounds(lo, hi)
+	walkNodes(first, end, visit)
+}
+
+// rangeBounds returns the first live node of the range [lo, hi) and
+// the live node following the range, nil if there is no such node,
+// so that the end of the range is found once and the walks between
+// the nodes by walkNodes agree on it. Both are the same node for
+// an empty range.
+func (t *Tree) rangeBounds(lo, hi []byte) (first, end *node) {
+	first = t.leftmost
+	if lo != nil {
+		first = t.ceiling(lo)
+	}
+	first = live(first)
+
+	if hi != nil {
+		end = live(t.ceiling(hi))
+	}
+	if first != nil && end != nil && bytes.Compare(first.key, end.key) >= 0 {
+		first = end
+	}
+
+	return first, end
+}
+
+// walkNodes calls visit for the live nodes from first up to, but not
+// including, end in ascending key order until visit returns false.
+func walkNodes(first, end *node, visit func(n *node) bool) {
+	for current := first; current != end; current = live(successor(current)) {
+		if !visit(current) {
+			return
+		}
+	}
+}
+
+// ceiling returns the node with the least key greater than or equal to
+// the given key, or nil if there is no such node.
+func (t *Tree) ceiling(key []byte) *node {
+	var candidate *node
+
+	current := t.root
+	for current != nil {
+		cmp := bytes.Compare(key, current.key)
+		if cmp < 0 {
+			candidate = current
+			current = current.left
+		} else if cmp > 0 {
+			current = current.right
+		} else {
+			return current
+		}
+	}
+
+	return candidate
+}
+
+// floor returns the node with the greatest key less than or equal to
+// the given key, or nil if there is no such node.
+func (t *Tree) floor(key []byte) *node {
+	var candidate *node
+
+	current := t.root
+	for current != nil {
+		cmp := bytes.Compare(key, current.key)
+		if cmp < 0 {
+			current = current.left
+		} else if cmp > 0 {
+			candidate = current
+			current = current.right
+		} else {
+			return current
+		}
+	}
+
+	return candidate
+}
+
+// higher returns the node with the least key strictly greater than
+// the given key, or nil if there is no such node.
+func (t *Tree) higher(key []byte) *node {
+	var candidate *node
+
+	current := t.root
+	for current != nil {
+		if bytes.Compare(key, current.key) < 0 {
+			candidate = current
+			current = current.left
+		} else {
+			current = current.right
+		}
+	}
+
+	return candidate
+}
+
+// lower returns the node with the greatest key strictly less than
+// the given key, or nil if there is no such node.
+func (t *Tree) lower(key []byte) *node {
+	var candidate *node
+
+	current := t.root
+	for current != nil {
+		if bytes.Compare(key, current.key) > 0 {
+			candidate = current
+			current = current.right
+		} else {
+			current = current.left
+		}
+	}
+
+	return candidate
+}
+
+// selectNode returns the node at the zero-based position i in ascending
+// key order, or nil if there is no such position.
+func (t *Tree) selectNode(i int) *node {
+	current := t.root
+	for current != nil {
+		leftSize := sizeOf(current.left)
+		if i < leftSize {
+			current = current.left
+		} else if i > leftSize {
+			i -= leftSize + 1
+			current = current.right
+		} else {
+			return current
+		}
+	}
+
+	return nil
+}
+
+// rank returns the zero-based position of the node in ascending key order.
+func rank(n *node) int {
+	r := sizeOf(n.left)
+	for ; n.parent != nil; n = n.parent {
+		if n == n.parent.right {
+			r += sizeOf(n.parent.left) + 1
+		}
+	}
+
+	return r
+}
+
+// minimum returns the node with the least key in the subtree.
+func minimum(n *node) *node {
+	for n.left != nil {
+		n = n.left
+	}
+
+	return n
+}
+
+// maximum returns the node with the greatest key in the subtree.
+func maximum(n *node) *node {
+	for n.right != nil {
+		n = n.right
+	}
+
+	return n
+}
+
+// successor returns the node with the next key in ascending order,
+// or nil if n holds the greatest key.
+func successor(n *node) *node {
+	if n.right != nil {
+		return minimum(n.right)
+	}
+
+	parent := n.parent
+	for parent != nil && n == parent.right {
+		n = parent
+		parent = parent.parent
+	}
+
+	return parent
+}
+
+// live returns the node itself or its nearest successor that is not
+// tombstoned, or nil if there is no such node.
+func live(n *node) *node {
+	for n != nil && n.deleted {
+		n = successor(n)
+	}
+
+	return n
+}
+
+// liveBefore returns the node itself or its nearest predecessor that
+// is not tombstoned, or nil if there is no such node.
+func liveBefore(n *node) *node {
+	for n != nil && n.deleted {
+		n = predecessor(n)
+	}
+
+	return n
+}
+
+// liveRank returns the zero-based position of the live node in ascending
+// key order among the live nodes. It takes O(n) time if the tree holds
+// tombstones, since the sizes of the subtrees count them.
+func (t *Tree) liveRank(n *node) int {
+	r := rank(n)
+	if t.tombstones == 0 {
+		return r
+	}
+
+	for current := t.leftmost; current != n; current = successor(current) {
+		if current.deleted {
+			r--
+		}
+	}
+
+	return r
+}
+
+// predecessor returns the node with the previous key in ascending order,
+// or nil if n holds the least key.
+func predecessor(n *node) *node {
+	if n.left != nil {
+		return maximum(n.left)
+	}
+
+	parent := n.parent
+	for parent != nil && n == parent.left {
+		n = parent
+		parent = parent.parent
+	}
+
+	return parent
+}
+
+// ByteSize returns the total length of all the keys and the total length
+// of all the values held in the tree, excluding any memory overhead.
+// Each key is counted once, even if it has multiple values.
+func (t *Tree) ByteSize() (keyBytes, valueBytes int) {
+	t.traverse(func(n *node) {
+		keyBytes += len(n.key)
+		valueBytes += len(n.value)
+		for _, duplicate := range n.duplicates {
+			valueBytes += len(duplicate)
+		}
+	})
+
+	return keyBytes, valueBytes
+}
+
+// Comparator returns the function that orders the keys of the tree,
+// which is always bytes.Compare.
+func (t *Tree) Comparator() func(a, b []byte) int {
+	return bytes.Compare
+}
+
+// ApproxSize returns a best-effort number of entries in the tree.
+// All the modes of the tree, including NewWithValueLoader and
+// NewWithTombstones, track the size exactly, so it is always equal
+// to Size.
+func (t *Tree) ApproxSize() int {
+	return t.Size()
+}
+
+// IsEmpty returns true if the tree has no entries.
+func (t *Tree) IsEmpty() bool {
+	return t.Size() == 0
 }
 
 // Size returns tree size.
 func (t *Tree) Size() int {
-	return t.size
+	return t.size - t.tombstones
+}
+
+// PrefixEnd returns the least key that is greater than all the keys
+// starting with the prefix, so that [prefix, PrefixEnd(prefix)) holds
+// exactly the keys with the prefix. It returns nil, meaning unbounded,
+// if the prefix is empty or consists only of 0xff bytes.
+func PrefixEnd(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			end := copyBytes(prefix[:i+1])
+			end[i]++
+
+			return end
+		}
+	}
+
+	return nil
+}
+
+// commonPrefixLength returns the length of the longest common prefix of a and b.
+func commonPrefixLength(a, b []byte) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+
+	return n
 }
 
 func copyBytes(s []byte) []byte {
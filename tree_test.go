@@ -2,12 +2,14 @@ package rbytree
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"math"
 	"math/rand"
 	"reflect"
 	"sort"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 )
@@ -64,150 +66,3170 @@ func TestNew(t *testing.T) {
 	}
 }
 
+func TestFromMap(t *testing.T) {
+	m := make(map[string][]byte)
+	for _, c := range treeCases {
+		m[string([]byte{c.key})] = []byte(c.value)
+	}
+
+	tree := FromMap(m)
+	if tree.Size() != len(m) {
+		t.Fatalf("expected size %d, but got %d", len(m), tree.Size())
+	}
+
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("tree is not valid: %s", err)
+	}
+
+	prev := -1
+	tree.ForEach(func(key, value []byte) {
+		if int(key[0]) <= prev {
+			t.Fatalf("keys are not in ascending order: %d after %d", key[0], prev)
+		}
+		prev = int(key[0])
+
+		if !bytes.Equal(value, m[string(key)]) {
+			t.Fatalf("expected value %s for key %d, but got %s", m[string(key)], key[0], value)
+		}
+	})
+}
+
+func TestFromEmptyMap(t *testing.T) {
+	tree := FromMap(map[string][]byte{})
+	if tree == nil {
+		t.Fatal("expected empty tree, but got nil")
+	}
+	if tree.Size() != 0 {
+		t.Fatalf("expected empty tree, but got size %d", tree.Size())
+	}
+}
+
+func TestEntries(t *testing.T) {
+	tree := New()
+
+	entries := tree.Entries()
+	if entries == nil || len(entries) != 0 {
+		t.Fatalf("expected empty non-nil slice, but got %v", entries)
+	}
+
+	for _, c := range treeCases {
+		tree.Put([]byte{c.key}, []byte(c.value))
+	}
+
+	entries = tree.Entries()
+	if len(entries) != len(treeCases) {
+		t.Fatalf("expected %d entries, but got %d", len(treeCases), len(entries))
+	}
+
+	for i, entry := range entries {
+		if i > 0 && bytes.Compare(entries[i-1].Key, entry.Key) >= 0 {
+			t.Fatalf("entries are not in ascending order: %v after %v", entry.Key, entries[i-1].Key)
+		}
+
+		value, _ := tree.Get(entry.Key)
+		if !bytes.Equal(value, entry.Value) {
+			t.Fatalf("expected value %s for key %v, but got %s", value, entry.Key, entry.Value)
+		}
+	}
+
+	for _, entry := range entries {
+		entry.Key[0], entry.Value[0] = 255, 'x'
+	}
+
+	if !reflect.DeepEqual(tree.Entries()[0], Entry{[]byte{0}, []byte("0")}) {
+		t.Fatal("modifying the entries must not affect the tree")
+	}
+}
+
+func TestToMap(t *testing.T) {
+	tree := New()
+
+	m := tree.ToMap()
+	if m == nil || len(m) != 0 {
+		t.Fatalf("expected empty non-nil map, but got %v", m)
+	}
+
+	for _, c := range treeCases {
+		tree.Put([]byte{c.key}, []byte(c.value))
+	}
+
+	m = tree.ToMap()
+	if len(m) != len(treeCases) {
+		t.Fatalf("expected %d entries, but got %d", len(treeCases), len(m))
+	}
+
+	for _, c := range treeCases {
+		value := m[string([]byte{c.key})]
+		if string(value) != c.value {
+			t.Fatalf("expected value %s for key %d, but got %s", c.value, c.key, value)
+		}
+
+		value[0] = 'x'
+		if stored, _ := tree.Get([]byte{c.key}); string(stored) != c.value {
+			t.Fatalf("modifying the map value must not affect the tree, but got %s", stored)
+		}
+	}
+}
+
+func TestMultiTree(t *testing.T) {
+	tree := NewMultiTree()
+
+	tree.Put([]byte("a"), []byte("1"))
+	tree.Put([]byte("b"), []byte("2"))
+
+	prev, exists := tree.Put([]byte("a"), []byte("3"))
+	if !exists || string(prev) != "1" {
+		t.Fatalf("expected previous value 1 and true, but got %s, %v", prev, exists)
+	}
+
+	prev, exists = tree.Put([]byte("a"), []byte("4"))
+	if !exists || string(prev) != "3" {
+		t.Fatalf("expected previous value 3 and true, but got %s, %v", prev, exists)
+	}
+
+	if tree.Size() != 2 {
+		t.Fatalf("expected size 2, but got %d", tree.Size())
+	}
+
+	if value, _ := tree.Get([]byte("a")); string(value) != "1" {
+		t.Fatalf("expected the first value 1, but got %s", value)
+	}
+
+	expected := [][]byte{[]byte("1"), []byte("3"), []byte("4")}
+	if values := tree.GetAll([]byte("a")); !reflect.DeepEqual(expected, values) {
+		t.Fatalf("%s != %s", expected, values)
+	}
+
+	expectedEntries := []string{"a=1", "a=3", "a=4", "b=2"}
+
+	entries := make([]string, 0)
+	tree.ForEach(func(key, value []byte) {
+		entries = append(entries, string(key)+"="+string(value))
+	})
+	if !reflect.DeepEqual(expectedEntries, entries) {
+		t.Fatalf("ForEach: %v != %v", expectedEntries, entries)
+	}
+
+	entries = entries[:0]
+	for it := tree.Iterator(); it.HasNext(); {
+		key, value := it.Next()
+		entries = append(entries, string(key)+"="+string(value))
+	}
+	if !reflect.DeepEqual(expectedEntries, entries) {
+		t.Fatalf("Iterator: %v != %v", expectedEntries, entries)
+	}
+
+	tree.Rebuild()
+	if values := tree.GetAll([]byte("a")); !reflect.DeepEqual(expected, values) {
+		t.Fatalf("duplicates must survive rebuild: %s != %s", expected, values)
+	}
+
+	if !tree.Delete([]byte("a")) {
+		t.Fatal("key a must be deleted")
+	}
+	if values := tree.GetAll([]byte("a")); values != nil {
+		t.Fatalf("all values of key a must be deleted, but got %s", values)
+	}
+	if tree.Size() != 1 {
+		t.Fatalf("expected size 1, but got %d", tree.Size())
+	}
+}
+
+func TestGetAll(t *testing.T) {
+	tree := New()
+
+	if values := tree.GetAll([]byte{1}); values != nil {
+		t.Fatalf("expected nil for the non-existent key, but got %v", values)
+	}
+
+	tree.Put([]byte{1}, []byte{1})
+	tree.Put([]byte{1}, []byte{2})
+
+	if values := tree.GetAll([]byte{1}); !reflect.DeepEqual([][]byte{{2}}, values) {
+		t.Fatalf("expected the only value, but got %v", values)
+	}
+}
+
 func TestPutAndGet(t *testing.T) {
 	tree := New()
 
 	for _, c := range treeCases {
-		prev, exists := tree.Put([]byte{c.key}, []byte(c.value))
-		if prev != nil {
-			t.Fatalf("the key already exists %v", c.key)
-		}
-		if exists {
-			t.Fatalf("the key already exists %v", c.key)
+		prev, exists := tree.Put([]byte{c.key}, []byte(c.value))
+		if prev != nil {
+			t.Fatalf("the key already exists %v", c.key)
+		}
+		if exists {
+			t.Fatalf("the key already exists %v", c.key)
+		}
+	}
+
+	for _, c := range treeCases {
+		value, ok := tree.Get([]byte{c.key})
+		if !ok {
+			t.Fatalf("failed to get value by key %d", c.key)
+		}
+
+		if string(value) != c.value {
+			t.Fatalf("expected to get value %s fo key %d, but got %s", c.value, c.key, string(value))
+		}
+	}
+}
+
+func TestSize(t *testing.T) {
+	tree := New()
+
+	expected := 0
+	for _, c := range treeCases {
+		if expected != tree.Size() {
+			t.Fatalf("actual size %d is not equal to expected size %d", tree.Size(), expected)
+		}
+
+		tree.Put([]byte{c.key}, []byte(c.value))
+		expected++
+	}
+}
+
+func TestComparator(t *testing.T) {
+	compare := New().Comparator()
+
+	tree := New()
+	for _, c := range treeCases {
+		tree.Put([]byte{c.key}, []byte(c.value))
+	}
+
+	var prev []byte
+	tree.ForEach(func(key, value []byte) {
+		if prev != nil && compare(prev, key) >= 0 {
+			t.Fatalf("expected %v to be ordered before %v", prev, key)
+		}
+		prev = key
+	})
+
+	if compare([]byte{1}, []byte{1}) != 0 || compare(nil, []byte{}) != 0 {
+		t.Fatal("expected equal keys to compare as 0")
+	}
+}
+
+func TestApproxSize(t *testing.T) {
+	trees := []*Tree{New(), NewWithTombstones(), NewWithValueLoader(func(key []byte) ([]byte, bool) {
+		return nil, false
+	})}
+
+	for _, tree := range trees {
+		for k := 0; k < 10; k++ {
+			tree.Put([]byte{byte(k)}, nil)
+		}
+		tree.Delete([]byte{3})
+
+		if tree.ApproxSize() != tree.Size() || tree.Size() != 9 {
+			t.Fatalf("expected approximate size equal to size 9, but got %d and %d", tree.ApproxSize(), tree.Size())
+		}
+	}
+}
+
+func TestIsEmpty(t *testing.T) {
+	tree := New()
+	if !tree.IsEmpty() {
+		t.Fatal("expected new tree to be empty")
+	}
+
+	tree.Put([]byte{1}, nil)
+	if tree.IsEmpty() {
+		t.Fatal("expected tree not to be empty")
+	}
+
+	tree.Delete([]byte{1})
+	if !tree.IsEmpty() {
+		t.Fatal("expected tree to be empty after deleting the last key")
+	}
+}
+
+func TestNewWithCapacity(t *testing.T) {
+	for _, capacity := range []int{-1, 0, 1, 10, 50} {
+		tree := NewWithCapacity(capacity)
+		for k := 0; k < 20; k++ {
+			tree.Put([]byte{byte(k)}, []byte{byte(k)})
+			// updates must not consume the preallocated nodes
+			tree.Put([]byte{byte(k)}, []byte{byte(k)})
+		}
+
+		if expected := capacity - 20; expected > 0 && len(tree.pool) != expected {
+			t.Fatalf("expected %d preallocated nodes left, but got %d", expected, len(tree.pool))
+		}
+
+		if err := tree.Validate(); err != nil {
+			t.Fatalf("tree with capacity %d is not valid: %s", capacity, err)
+		}
+		if tree.Size() != 20 {
+			t.Fatalf("expected size 20, but got %d", tree.Size())
+		}
+		for k := 0; k < 20; k++ {
+			if value, ok := tree.Get([]byte{byte(k)}); !ok || value[0] != byte(k) {
+				t.Fatalf("expected value %d, but got %v, %v", k, value, ok)
+			}
+		}
+	}
+}
+
+func TestNil(t *testing.T) {
+	tree := New()
+
+	tree.Put(nil, []byte{1})
+
+	_, ok := tree.Get(nil)
+	if !ok {
+		t.Fatalf("key nil is not found")
+	}
+}
+
+func TestPutOverrides(t *testing.T) {
+	tree := New()
+
+	prev, exists := tree.Put([]byte{1}, []byte{1})
+	if prev != nil {
+		t.Fatal("previous value must be nil for the new key")
+	}
+	if exists {
+		t.Fatal("previous value must be nil for the new key")
+	}
+
+	prev, exists = tree.Put([]byte{1}, []byte{2})
+	if !bytes.Equal(prev, []byte{1}) {
+		t.Fatalf("previous value must be %v, but got %v", []byte{1}, prev)
+	}
+	if !exists {
+		t.Fatalf("exists must be true for key %v", []byte{1})
+	}
+
+	value, ok := tree.Get([]byte{1})
+	if !ok {
+		t.Fatalf("key %d is not found, but must be overridden", 1)
+	}
+
+	if !bytes.Equal(value, []byte{2}) {
+		t.Fatalf("key %d is not overridden", 1)
+	}
+}
+
+func TestFromSlices(t *testing.T) {
+	keys := [][]byte{{3}, {1}, {2}, {1}}
+	values := [][]byte{{30}, {10}, {20}, {11}}
+
+	tree, err := FromSlices(keys, values)
+	if err != nil {
+		t.Fatalf("failed to create tree: %s", err)
+	}
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("tree is not valid: %s", err)
+	}
+
+	expected := []Entry{{[]byte{1}, []byte{11}}, {[]byte{2}, []byte{20}}, {[]byte{3}, []byte{30}}}
+	if entries := tree.Entries(); !reflect.DeepEqual(expected, entries) {
+		t.Fatalf("expected %v, but got %v", expected, entries)
+	}
+
+	if _, err := FromSlices(keys, values[:3]); err == nil {
+		t.Fatal("expected error for slices of different lengths")
+	}
+
+	tree, err = FromSlices(nil, nil)
+	if err != nil || tree.Size() != 0 {
+		t.Fatalf("expected empty tree, but got size %d and error %v", tree.Size(), err)
+	}
+}
+
+func TestBuildFromUnsortedDeterministic(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 7, 100, 1000} {
+		pairs := make([]Entry, n)
+		for i := range pairs {
+			key := []byte{byte(i >> 8), byte(i)}
+			pairs[i] = Entry{key, key}
+		}
+
+		for seed := int64(0); seed < 10; seed++ {
+			tree := BuildFromUnsortedDeterministic(seed, pairs)
+
+			if err := tree.Validate(); err != nil {
+				t.Fatalf("tree of size %d built with seed %d is not valid: %s", n, seed, err)
+			}
+			if tree.Size() != n {
+				t.Fatalf("expected size %d, but got %d", n, tree.Size())
+			}
+			if bound := 2 * math.Log2(float64(n+1)); float64(height(tree.root)) > bound {
+				t.Fatalf("height %d exceeds the bound %f", height(tree.root), bound)
+			}
+
+			again := BuildFromUnsortedDeterministic(seed, pairs)
+			if shape(tree.root) != shape(again.root) {
+				t.Fatalf("expected the same tree for seed %d", seed)
+			}
+		}
+	}
+}
+
+func TestIsStrictlySorted(t *testing.T) {
+	cases := []struct {
+		keys     [][]byte
+		expected bool
+	}{
+		{nil, true},
+		{[][]byte{{1}}, true},
+		{[][]byte{nil, {0}, {0, 0}, {1}}, true},
+		{[][]byte{{1}, {2}, {2}}, false},
+		{[][]byte{{1}, {3}, {2}}, false},
+		{[][]byte{{}, nil}, false},
+	}
+
+	for _, c := range cases {
+		pairs := make([]Entry, len(c.keys))
+		for i, key := range c.keys {
+			pairs[i] = Entry{key, nil}
+		}
+
+		if actual := IsStrictlySorted(pairs); actual != c.expected {
+			t.Fatalf("%v: expected %v, but got %v", c.keys, c.expected, actual)
+		}
+	}
+}
+
+func TestPutReport(t *testing.T) {
+	tree := New()
+
+	expected := []int{0, 0, 1, 0, 1, 0, 1, 1}
+	for k, rotations := range expected {
+		if actual := tree.PutReport([]byte{byte(k)}, nil); actual != rotations {
+			t.Fatalf("key %d: expected %d rotations, but got %d", k, rotations, actual)
+		}
+	}
+
+	if rotations := tree.PutReport([]byte{byte(2)}, []byte{1}); rotations != 0 {
+		t.Fatalf("expected 0 rotations for the overwrite, but got %d", rotations)
+	}
+
+	// zig-zag insertion requires the double rotation
+	tree = New()
+	tree.PutReport([]byte{3}, nil)
+	tree.PutReport([]byte{1}, nil)
+	if rotations := tree.PutReport([]byte{2}, nil); rotations != 2 {
+		t.Fatalf("expected 2 rotations, but got %d", rotations)
+	}
+}
+
+func TestPutUnique(t *testing.T) {
+	tree := New()
+
+	if err := tree.PutUnique([]byte("a"), []byte{1}); err != nil {
+		t.Fatalf("expected no error, but got %s", err)
+	}
+
+	err := tree.PutUnique([]byte("a"), []byte{2})
+	duplicate, ok := err.(*DuplicateKeyError)
+	if !ok {
+		t.Fatalf("expected *DuplicateKeyError, but got %v", err)
+	}
+	if !bytes.Equal(duplicate.Key, []byte("a")) {
+		t.Fatalf("expected key a, but got %v", duplicate.Key)
+	}
+	if err.Error() != `key "a" already exists` {
+		t.Fatalf("unexpected error message: %s", err)
+	}
+
+	if value, _ := tree.Get([]byte("a")); !bytes.Equal(value, []byte{1}) {
+		t.Fatalf("expected the value to stay unchanged, but got %v", value)
+	}
+	if tree.Size() != 1 {
+		t.Fatalf("expected size 1, but got %d", tree.Size())
+	}
+}
+
+func TestPutAll(t *testing.T) {
+	tree := New()
+
+	tree.PutAll(nil)
+	if tree.Size() != 0 {
+		t.Fatalf("expected empty tree, but got size %d", tree.Size())
+	}
+
+	tree.PutAll([]Entry{
+		{[]byte{2}, []byte{1}},
+		{[]byte{1}, []byte{1}},
+		{[]byte{2}, []byte{2}},
+		{[]byte{3}, []byte{3}},
+	})
+
+	if tree.Size() != 3 {
+		t.Fatalf("expected size 3, but got %d", tree.Size())
+	}
+	if value, _ := tree.Get([]byte{2}); !bytes.Equal(value, []byte{2}) {
+		t.Fatalf("expected the last value to win, but got %v", value)
+	}
+}
+
+func TestPutAllCounting(t *testing.T) {
+	tree := New()
+	tree.Put([]byte{1}, []byte{1})
+
+	inserted, updated := tree.PutAllCounting([]Entry{
+		{[]byte{2}, []byte{2}},
+		{[]byte{1}, []byte{10}},
+		{[]byte{3}, []byte{3}},
+		{[]byte{2}, []byte{20}},
+	})
+
+	if inserted != 2 || updated != 2 {
+		t.Fatalf("expected 2 inserted and 2 updated, but got %d and %d", inserted, updated)
+	}
+	if tree.Size() != 3 {
+		t.Fatalf("expected size 3, but got %d", tree.Size())
+	}
+	if value, _ := tree.Get([]byte{2}); !bytes.Equal(value, []byte{20}) {
+		t.Fatalf("expected the last value to win, but got %v", value)
+	}
+
+	if inserted, updated := tree.PutAllCounting(nil); inserted != 0 || updated != 0 {
+		t.Fatalf("expected 0 and 0, but got %d and %d", inserted, updated)
+	}
+}
+
+func TestWindow(t *testing.T) {
+	tree := New()
+	if window := tree.Window([]byte{1}, 2, 2); len(window) != 0 {
+		t.Fatalf("expected empty window, but got %v", window)
+	}
+
+	for k := 0; k < 10; k++ {
+		tree.Put([]byte{byte(k * 2)}, []byte{byte(k)})
+	}
+
+	cases := []struct {
+		pivot         []byte
+		before, after int
+		expected      []byte
+	}{
+		{[]byte{10}, 2, 2, []byte{6, 8, 10, 12}},
+		{[]byte{11}, 2, 2, []byte{8, 10, 12, 14}},
+		{[]byte{2}, 3, 1, []byte{0, 2}},
+		{[]byte{16}, 1, 5, []byte{14, 16, 18}},
+		{[]byte{10}, 0, 0, []byte{}},
+		{[]byte{10}, 0, 1, []byte{10}},
+		{[]byte{10}, 1, 0, []byte{8}},
+		{[]byte{100}, 2, 2, []byte{16, 18}},
+		{nil, 2, 2, []byte{0, 2}},
+		{[]byte{10}, 20, 20, []byte{0, 2, 4, 6, 8, 10, 12, 14, 16, 18}},
+	}
+
+	for _, c := range cases {
+		window := tree.Window(c.pivot, c.before, c.after)
+
+		keys := make([]byte, 0)
+		for _, entry := range window {
+			if entry.Value[0]*2 != entry.Key[0] {
+				t.Fatalf("expected value %d, but got %d", entry.Key[0]/2, entry.Value[0])
+			}
+			keys = append(keys, entry.Key[0])
+		}
+		if !bytes.Equal(keys, c.expected) {
+			t.Fatalf("pivot %v: expected %v, but got %v", c.pivot, c.expected, keys)
+		}
+	}
+}
+
+func TestMultiRange(t *testing.T) {
+	tree := New()
+	for k := 0; k < 20; k++ {
+		tree.Put([]byte{byte(k)}, []byte{byte(k)})
+	}
+
+	type ranges = []struct{ Lo, Hi []byte }
+	cases := []struct {
+		ranges   ranges
+		expected []byte
+	}{
+		{ranges{}, []byte{}},
+		{ranges{{[]byte{2}, []byte{4}}}, []byte{2, 3}},
+		{ranges{{[]byte{10}, []byte{12}}, {[]byte{2}, []byte{4}}}, []byte{2, 3, 10, 11}},
+		{ranges{{[]byte{2}, []byte{6}}, {[]byte{4}, []byte{8}}}, []byte{2, 3, 4, 5, 6, 7}},
+		{ranges{{[]byte{2}, []byte{10}}, {[]byte{4}, []byte{6}}}, []byte{2, 3, 4, 5, 6, 7, 8, 9}},
+		{ranges{{[]byte{3}, []byte{5}}, {[]byte{3}, []byte{5}}}, []byte{3, 4}},
+		{ranges{{[]byte{17}, nil}, {nil, []byte{2}}}, []byte{0, 1, 17, 18, 19}},
+		{ranges{{nil, []byte{3}}, {[]byte{1}, []byte{4}}}, []byte{0, 1, 2, 3}},
+		{ranges{{[]byte{5}, []byte{5}}, {[]byte{8}, []byte{6}}}, []byte{}},
+		{ranges{{[]byte{30}, nil}}, []byte{}},
+	}
+
+	for _, c := range cases {
+		keys := make([]byte, 0)
+		tree.MultiRange(c.ranges, func(key, value []byte) {
+			keys = append(keys, key[0])
+		})
+
+		if !bytes.Equal(keys, c.expected) {
+			t.Fatalf("%v: expected %v, but got %v", c.ranges, c.expected, keys)
+		}
+	}
+}
+
+func TestSumRange(t *testing.T) {
+	decode := func(value []byte) int64 {
+		return int64(binary.BigEndian.Uint64(value))
+	}
+
+	tree := New()
+	if sum := tree.SumRange(nil, nil, decode); sum != 0 {
+		t.Fatalf("expected 0 for empty tree, but got %d", sum)
+	}
+
+	for k := 1; k <= 10; k++ {
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, uint64(k*10))
+		tree.Put([]byte{byte(k)}, value)
+	}
+
+	cases := []struct {
+		lo, hi   []byte
+		expected int64
+	}{
+		{nil, nil, 550},
+		{[]byte{3}, []byte{5}, 70},
+		{nil, []byte{3}, 30},
+		{[]byte{9}, nil, 190},
+		{[]byte{5}, []byte{5}, 0},
+		{[]byte{11}, nil, 0},
+	}
+
+	for _, c := range cases {
+		if sum := tree.SumRange(c.lo, c.hi, decode); sum != c.expected {
+			t.Fatalf("[%v, %v): expected %d, but got %d", c.lo, c.hi, c.expected, sum)
+		}
+	}
+}
+
+func TestPage(t *testing.T) {
+	tree := New()
+
+	if entries, next := tree.Page(nil, 10); len(entries) != 0 || next != nil {
+		t.Fatalf("expected no entries and nil next, but got %v and %v", entries, next)
+	}
+
+	for i := 0; i < 7; i++ {
+		tree.Put([]byte{byte(i)}, []byte{byte(i * 10)})
+	}
+
+	var keys []byte
+	pages := 0
+	var after []byte
+	for {
+		entries, next := tree.Page(after, 3)
+		pages++
+		for _, entry := range entries {
+			if entry.Value[0] != entry.Key[0]*10 {
+				t.Fatalf("expected value %d, but got %d", entry.Key[0]*10, entry.Value[0])
+			}
+			keys = append(keys, entry.Key[0])
+		}
+
+		if next == nil {
+			break
+		}
+		after = next
+	}
+
+	if pages != 3 {
+		t.Fatalf("expected 3 pages, but got %d", pages)
+	}
+	if !bytes.Equal(keys, []byte{0, 1, 2, 3, 4, 5, 6}) {
+		t.Fatalf("expected all the keys once, but got %v", keys)
+	}
+
+	entries, next := tree.Page([]byte{3}, 3)
+	if len(entries) != 3 || entries[0].Key[0] != 4 || next != nil {
+		t.Fatalf("expected the last 3 entries and nil next, but got %v and %v", entries, next)
+	}
+
+	entries, next = tree.Page([]byte{2, 5}, 2)
+	if len(entries) != 2 || entries[0].Key[0] != 3 || !bytes.Equal(next, []byte{4}) {
+		t.Fatalf("expected entries from 3 and next 4, but got %v and %v", entries, next)
+	}
+
+	if entries, next := tree.Page([]byte{6}, 3); len(entries) != 0 || next != nil {
+		t.Fatalf("expected no entries and nil next, but got %v and %v", entries, next)
+	}
+	if entries, next := tree.Page(nil, 0); len(entries) != 0 || next != nil {
+		t.Fatalf("expected no entries and nil next, but got %v and %v", entries, next)
+	}
+}
+
+func TestPutBatch(t *testing.T) {
+	for n := 0; n <= 32; n++ {
+		tree := New()
+		expected := New()
+		for k := 0; k < n; k++ {
+			tree.Put([]byte{byte(k * 2)}, []byte{byte(k)})
+			expected.Put([]byte{byte(k * 2)}, []byte{byte(k)})
+		}
+
+		ops := make([]Op, 0)
+		tree.OnChange(func(op Op, key, value []byte) {
+			ops = append(ops, op)
+		})
+
+		tree.PutBatch(func(put func(key, value []byte)) {
+			for k := n; k >= 0; k-- {
+				put([]byte{byte(k)}, []byte{byte(k + 100)})
+				expected.Put([]byte{byte(k)}, []byte{byte(k + 100)})
+			}
+			put([]byte{0}, []byte{200})
+			expected.Put([]byte{0}, []byte{200})
+
+			if tree.Size() != n {
+				t.Fatal("expected the tree not to be modified during the batch")
+			}
+		})
+
+		if err := tree.Validate(); err != nil {
+			t.Fatalf("tree of size %d is not valid after batch: %s", n, err)
+		}
+		if !equalEntries(tree, expected) {
+			t.Fatalf("expected %v, but got %v", expected.Entries(), tree.Entries())
+		}
+		if len(ops) != n+2 {
+			t.Fatalf("expected %d notifications, but got %d", n+2, len(ops))
+		}
+	}
+}
+
+func TestPutBatchNotifiesAfterPut(t *testing.T) {
+	tree := New()
+	tree.Put([]byte{2}, []byte{2})
+
+	keys := make([]byte, 0)
+	tree.OnChange(func(op Op, key, value []byte) {
+		if stored, ok := tree.Get(key); !ok || !bytes.Equal(stored, value) {
+			t.Fatalf("expected key %d to be put before the notification, but got %v, %v", key[0], stored, ok)
+		}
+		if tree.Size() != 3 {
+			t.Fatalf("expected size 3 in the notification, but got %d", tree.Size())
+		}
+		keys = append(keys, key[0])
+	})
+
+	tree.PutBatch(func(put func(key, value []byte)) {
+		put([]byte{3}, []byte{3})
+		put([]byte{2}, []byte{20})
+		put([]byte{1}, []byte{1})
+	})
+
+	if !bytes.Equal(keys, []byte{3, 2, 1}) {
+		t.Fatalf("expected notifications in the order of the batch, but got %v", keys)
+	}
+}
+
+func TestPutBatchForSmallBatch(t *testing.T) {
+	tree := New()
+	for k := 0; k < 1000; k++ {
+		tree.Put([]byte{byte(k >> 8), byte(k)}, []byte{1})
+	}
+	existing := tree.getNode([]byte{0, 10})
+
+	keys := make([][]byte, 0)
+	tree.OnChange(func(op Op, key, value []byte) {
+		if stored, ok := tree.Get(key); !ok || !bytes.Equal(stored, value) {
+			t.Fatalf("expected key %v to be put before the notification", key)
+		}
+		keys = append(keys, key)
+	})
+
+	tree.PutBatch(func(put func(key, value []byte)) {
+		put([]byte{9, 0}, []byte{2})
+		put([]byte{0, 10}, []byte{2})
+		put([]byte{9, 0}, []byte{3})
+	})
+
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("tree is not valid after batch: %s", err)
+	}
+	if !reflect.DeepEqual(keys, [][]byte{{9, 0}, {0, 10}, {9, 0}}) {
+		t.Fatalf("expected notifications in the order of the batch, but got %v", keys)
+	}
+	if value, _ := tree.Get([]byte{9, 0}); !bytes.Equal(value, []byte{3}) {
+		t.Fatalf("expected the last value to win, but got %v", value)
+	}
+	if tree.Size() != 1001 {
+		t.Fatalf("expected size 1001, but got %d", tree.Size())
+	}
+	if tree.getNode([]byte{0, 10}) != existing {
+		t.Fatal("expected the nodes to be kept")
+	}
+}
+
+func TestPutBatchKeepsNodes(t *testing.T) {
+	tree := New()
+	for k := 0; k < 10; k++ {
+		tree.Put([]byte{byte(k * 2)}, []byte{byte(k)})
+	}
+	existing := tree.getNode([]byte{4})
+
+	tree.PutBatch(func(put func(key, value []byte)) {
+		for k := 0; k < 20; k++ {
+			put([]byte{byte(k)}, []byte{byte(k)})
+		}
+	})
+
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("tree is not valid after batch: %s", err)
+	}
+	if tree.getNode([]byte{4}) != existing {
+		t.Fatal("expected the nodes to be relinked instead of reallocated")
+	}
+}
+
+func TestPutBatchForMultiTree(t *testing.T) {
+	tree := NewMultiTree()
+	tree.Put([]byte{1}, []byte{1})
+
+	tree.PutBatch(func(put func(key, value []byte)) {
+		put([]byte{2}, []byte{2})
+		put([]byte{1}, []byte{3})
+		put([]byte{2}, []byte{4})
+	})
+
+	if values := tree.GetAll([]byte{1}); !reflect.DeepEqual(values, [][]byte{{1}, {3}}) {
+		t.Fatalf("expected values [1 3], but got %v", values)
+	}
+	if values := tree.GetAll([]byte{2}); !reflect.DeepEqual(values, [][]byte{{2}, {4}}) {
+		t.Fatalf("expected values [2 4], but got %v", values)
+	}
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("tree is not valid after batch: %s", err)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	tree := New()
+
+	if prev, ok := tree.Replace([]byte{1}, []byte{1}); ok || prev != nil {
+		t.Fatalf("expected nil and false, but got %v, %v", prev, ok)
+	}
+	if tree.Size() != 0 {
+		t.Fatal("Replace must not insert the key")
+	}
+
+	stored := []byte{1}
+	tree.Put([]byte{1}, stored)
+
+	prev, ok := tree.Replace([]byte{1}, []byte{2})
+	if !ok || !bytes.Equal(prev, []byte{1}) {
+		t.Fatalf("expected previous value 1, but got %v, %v", prev, ok)
+	}
+	if &prev[0] == &stored[0] {
+		t.Fatal("expected a copy of the previous value")
+	}
+
+	if value, _ := tree.Get([]byte{1}); !bytes.Equal(value, []byte{2}) {
+		t.Fatalf("expected value 2, but got %v", value)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	tree := New()
+
+	if tree.CompareAndSwap([]byte{1}, nil, []byte{1}) {
+		t.Fatal("expected false for the non-existent key")
+	}
+	if _, ok := tree.Get([]byte{1}); ok {
+		t.Fatal("CompareAndSwap must not insert the key")
+	}
+
+	tree.Put([]byte{1}, []byte{1})
+
+	if tree.CompareAndSwap([]byte{1}, []byte{2}, []byte{3}) {
+		t.Fatal("expected false for the different old value")
+	}
+	if value, _ := tree.Get([]byte{1}); !bytes.Equal(value, []byte{1}) {
+		t.Fatalf("value must not be swapped, but got %v", value)
+	}
+
+	if !tree.CompareAndSwap([]byte{1}, []byte{1}, []byte{3}) {
+		t.Fatal("expected true for the equal old value")
+	}
+	if value, _ := tree.Get([]byte{1}); !bytes.Equal(value, []byte{3}) {
+		t.Fatalf("value must be swapped, but got %v", value)
+	}
+}
+
+func TestGetForNonExistentValue(t *testing.T) {
+	tree := New()
+
+	for _, c := range treeCases {
+		tree.Put([]byte{c.key}, []byte(c.value))
+	}
+
+	value, ok := tree.Get([]byte{230})
+	if value != nil {
+		t.Fatalf("expected value to be nil, but got %s", value)
+	}
+	if ok {
+		t.Fatalf("expected ok to be false, but got %v", ok)
+	}
+}
+
+func TestGetForEmptyTree(t *testing.T) {
+	tree := New()
+
+	value, ok := tree.Get([]byte{1})
+	if value != nil {
+		t.Fatalf("expected value to be nil, but got %s", value)
+	}
+	if ok {
+		t.Fatalf("expected ok to be false, but got %v", ok)
+	}
+}
+
+func TestGetCopy(t *testing.T) {
+	tree := New()
+
+	if value, ok := tree.GetCopy([]byte{1}); value != nil || ok {
+		t.Fatalf("expected nil and false for the non-existent key, but got %v, %v", value, ok)
+	}
+
+	tree.Put([]byte{1}, []byte{1, 2, 3})
+
+	value, ok := tree.GetCopy([]byte{1})
+	if !ok || !bytes.Equal(value, []byte{1, 2, 3}) {
+		t.Fatalf("expected %v and true, but got %v, %v", []byte{1, 2, 3}, value, ok)
+	}
+
+	value[0] = 4
+	if stored, _ := tree.Get([]byte{1}); !bytes.Equal(stored, []byte{1, 2, 3}) {
+		t.Fatalf("modifying the copy must not affect the stored value, but got %v", stored)
+	}
+}
+
+func TestGetWithNeighbors(t *testing.T) {
+	tree := New()
+
+	_, prev, next, found := tree.GetWithNeighbors([]byte{1})
+	if prev != nil || next != nil || found {
+		t.Fatalf("expected no neighbors for the empty tree, but got %v, %v, %v", prev, next, found)
+	}
+
+	// keys: 0 1 2 7 11 14 15 16 18 25 33 42 60 74
+	for _, c := range treeCases {
+		tree.Put([]byte{c.key}, []byte(c.value))
+	}
+
+	cases := []struct {
+		key   byte
+		value string
+		prev  []byte
+		next  []byte
+		found bool
+	}{
+		{0, "0", nil, []byte{1}, true},
+		{11, "11", []byte{7}, []byte{14}, true},
+		{18, "18", []byte{16}, []byte{25}, true},
+		{74, "74", []byte{60}, nil, true},
+		{3, "", []byte{2}, []byte{7}, false},
+		{17, "", []byte{16}, []byte{18}, false},
+		{75, "", []byte{74}, nil, false},
+	}
+
+	for _, c := range cases {
+		value, prev, next, found := tree.GetWithNeighbors([]byte{c.key})
+		if string(value) != c.value || found != c.found {
+			t.Fatalf("key %d: expected %s, %v, but got %s, %v", c.key, c.value, c.found, value, found)
+		}
+		if !bytes.Equal(prev, c.prev) || (prev == nil) != (c.prev == nil) {
+			t.Fatalf("key %d: expected previous key %v, but got %v", c.key, c.prev, prev)
+		}
+		if !bytes.Equal(next, c.next) || (next == nil) != (c.next == nil) {
+			t.Fatalf("key %d: expected next key %v, but got %v", c.key, c.next, next)
+		}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	random := rand.New(rand.NewSource(42))
+
+	for round := 0; round < 16; round++ {
+		tree := New()
+		keys := random.Perm(256)
+		for _, k := range keys {
+			tree.Put([]byte{byte(k)}, []byte{byte(k)})
+		}
+
+		for i, k := range random.Perm(256) {
+			if !tree.Delete([]byte{byte(k)}) {
+				t.Fatalf("key %d must be deleted", k)
+			}
+
+			if err := tree.Validate(); err != nil {
+				t.Fatalf("tree is not valid after deleting %d: %s", k, err)
+			}
+
+			if _, ok := tree.Get([]byte{byte(k)}); ok {
+				t.Fatalf("key %d is found after deletion", k)
+			}
+
+			if tree.Size() != 256-i-1 {
+				t.Fatalf("expected size %d, but got %d", 256-i-1, tree.Size())
+			}
+		}
+
+		if tree.root != nil {
+			t.Fatal("tree must be empty after deleting all keys")
+		}
+	}
+}
+
+// nodeSpec describes the node of the tree built for a test.
+type nodeSpec struct {
+	key   byte
+	color color
+	left  *nodeSpec
+	right *nodeSpec
+}
+
+func blackSpec(key byte, left, right *nodeSpec) *nodeSpec {
+	return &nodeSpec{key, black, left, right}
+}
+
+func redSpec(key byte, left, right *nodeSpec) *nodeSpec {
+	return &nodeSpec{key, red, left, right}
+}
+
+// mirrorSpec returns the mirror image of the spec with keys reversed,
+// so that the symmetric cases can be tested with the same specs.
+func mirrorSpec(spec *nodeSpec) *nodeSpec {
+	if spec == nil {
+		return nil
+	}
+
+	return &nodeSpec{100 - spec.key, spec.color, mirrorSpec(spec.right), mirrorSpec(spec.left)}
+}
+
+func buildTreeFromSpec(spec *nodeSpec) *Tree {
+	tree := New()
+	tree.setRoot(buildNodeFromSpec(spec, nil))
+
+	return tree
+}
+
+func buildNodeFromSpec(spec *nodeSpec, parent *node) *node {
+	if spec == nil {
+		return nil
+	}
+
+	n := &node{key: []byte{spec.key}, value: []byte{spec.key}, parent: parent, color: spec.color}
+	n.left = buildNodeFromSpec(spec.left, n)
+	n.right = buildNodeFromSpec(spec.right, n)
+	n.size = sizeOf(n.left) + sizeOf(n.right) + 1
+
+	return n
+}
+
+// shape describes the structure and the colors of the subtree,
+// e.g. "10B(5R . 15R)".
+func shape(n *node) string {
+	if n == nil {
+		return "."
+	}
+
+	c := "B"
+	if n.color == red {
+		c = "R"
+	}
+
+	if n.left == nil && n.right == nil {
+		return fmt.Sprintf("%d%s", n.key[0], c)
+	}
+
+	return fmt.Sprintf("%d%s(%s %s)", n.key[0], c, shape(n.left), shape(n.right))
+}
+
+func TestFixAfterDeletionCases(t *testing.T) {
+	cases := []struct {
+		name     string
+		tree     *nodeSpec
+		delete   byte
+		expected *nodeSpec
+		// deletion of a node with two children takes its successor,
+		// so the case has no mirror image
+		asymmetric bool
+	}{
+		{
+			"red leaf without fixing",
+			blackSpec(10, redSpec(5, nil, nil), redSpec(15, nil, nil)),
+			5,
+			blackSpec(10, nil, redSpec(15, nil, nil)),
+			false,
+		},
+		{
+			"red sibling",
+			blackSpec(10, blackSpec(5, nil, nil), redSpec(20, blackSpec(15, nil, nil), blackSpec(25, nil, nil))),
+			5,
+			blackSpec(20, blackSpec(10, nil, redSpec(15, nil, nil)), blackSpec(25, nil, nil)),
+			false,
+		},
+		{
+			"black sibling with black nephews and black parent",
+			blackSpec(10, blackSpec(5, nil, nil), blackSpec(15, nil, nil)),
+			5,
+			blackSpec(10, nil, redSpec(15, nil, nil)),
+			false,
+		},
+		{
+			"black sibling with black nephews and red parent",
+			blackSpec(10,
+				redSpec(5, blackSpec(3, nil, nil), blackSpec(7, nil, nil)),
+				blackSpec(20, redSpec(15, nil, nil), redSpec(25, nil, nil)),
+			),
+			3,
+			blackSpec(10,
+				blackSpec(5, nil, redSpec(7, nil, nil)),
+				blackSpec(20, redSpec(15, nil, nil), redSpec(25, nil, nil)),
+			),
+			false,
+		},
+		{
+			"black sibling with red near nephew and black far nephew",
+			blackSpec(10, blackSpec(5, nil, nil), blackSpec(20, redSpec(15, nil, nil), nil)),
+			5,
+			blackSpec(15, blackSpec(10, nil, nil), blackSpec(20, nil, nil)),
+			false,
+		},
+		{
+			"black sibling with red far nephew",
+			blackSpec(10, blackSpec(5, nil, nil), blackSpec(20, nil, redSpec(25, nil, nil))),
+			5,
+			blackSpec(20, blackSpec(10, nil, nil), blackSpec(25, nil, nil)),
+			false,
+		},
+		{
+			"node with two children replaced by its successor",
+			blackSpec(10,
+				blackSpec(5, nil, nil),
+				redSpec(20, blackSpec(15, nil, nil), blackSpec(25, nil, nil)),
+			),
+			10,
+			blackSpec(15,
+				blackSpec(5, nil, nil),
+				blackSpec(20, nil, redSpec(25, nil, nil)),
+			),
+			true,
+		},
+	}
+
+	for _, c := range cases {
+		for _, mirrored := range []bool{false, true} {
+			if mirrored && c.asymmetric {
+				continue
+			}
+
+			spec, expected, key := c.tree, c.expected, c.delete
+			if mirrored {
+				spec, expected, key = mirrorSpec(spec), mirrorSpec(expected), 100-key
+			}
+
+			tree := buildTreeFromSpec(spec)
+			if err := tree.Validate(); err != nil {
+				t.Fatalf("%s (mirrored=%v): initial tree is not valid: %s", c.name, mirrored, err)
+			}
+
+			if !tree.Delete([]byte{key}) {
+				t.Fatalf("%s (mirrored=%v): key %d must be deleted", c.name, mirrored, key)
+			}
+
+			if err := tree.Validate(); err != nil {
+				t.Fatalf("%s (mirrored=%v): tree is not valid after deletion: %s", c.name, mirrored, err)
+			}
+
+			actualShape := shape(tree.root)
+			expectedShape := shape(buildTreeFromSpec(expected).root)
+			if actualShape != expectedShape {
+				t.Fatalf("%s (mirrored=%v): expected %s, but got %s", c.name, mirrored, expectedShape, actualShape)
+			}
+		}
+	}
+}
+
+func TestDeleteForNonExistentKey(t *testing.T) {
+	tree := New()
+
+	if tree.Delete([]byte{1}) {
+		t.Fatal("expected false for the empty tree")
+	}
+
+	for _, c := range treeCases {
+		tree.Put([]byte{c.key}, []byte(c.value))
+	}
+
+	if tree.Delete([]byte{230}) {
+		t.Fatal("expected false for the non-existent key")
+	}
+	if tree.Size() != len(treeCases) {
+		t.Fatalf("expected size %d, but got %d", len(treeCases), tree.Size())
+	}
+}
+
+func TestWouldPut(t *testing.T) {
+	tree := NewWithTombstones()
+	tree.Put([]byte{1}, []byte{1})
+	tree.Put([]byte{2}, []byte{2})
+	tree.Delete([]byte{2})
+
+	if !tree.WouldPut([]byte{1}) {
+		t.Fatal("expected Put of the existing key to overwrite")
+	}
+	if tree.WouldPut([]byte{2}) {
+		t.Fatal("expected Put of the deleted key to insert")
+	}
+	if tree.WouldPut([]byte{3}) {
+		t.Fatal("expected Put of the missing key to insert")
+	}
+
+	version := tree.version
+	tree.WouldPut([]byte{3})
+	if tree.version != version || tree.Size() != 1 {
+		t.Fatal("expected the tree not to be modified")
+	}
+}
+
+func TestGetOrDefault(t *testing.T) {
+	tree := New()
+	stored := []byte{1}
+	tree.Put([]byte{1}, stored)
+	tree.Put([]byte{2}, nil)
+	def := []byte{9}
+
+	if value := tree.GetOrDefault([]byte{1}, def); &value[0] != &stored[0] {
+		t.Fatalf("expected the stored value, but got %v", value)
+	}
+	if value := tree.GetOrDefault([]byte{2}, def); value != nil {
+		t.Fatalf("expected the stored nil value, but got %v", value)
+	}
+	if value := tree.GetOrDefault([]byte{3}, def); &value[0] != &def[0] {
+		t.Fatalf("expected the default value, but got %v", value)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	tree := New()
+	for _, c := range treeCases {
+		tree.Put([]byte{c.key}, []byte(c.value))
+	}
+
+	for _, c := range treeCases {
+		value, ok := tree.Remove([]byte{c.key})
+		if !ok {
+			t.Fatalf("key %d must be removed", c.key)
+		}
+		if string(value) != c.value {
+			t.Fatalf("expected removed value %s, but got %s", c.value, value)
+		}
+
+		if err := tree.Validate(); err != nil {
+			t.Fatalf("tree is not valid after removing %d: %s", c.key, err)
+		}
+	}
+
+	value, ok := tree.Remove([]byte{1})
+	if ok || value != nil {
+		t.Fatalf("expected nil and false for the non-existent key, but got %v, %v", value, ok)
+	}
+}
+
+func TestRemoveReturnsCopy(t *testing.T) {
+	tree := New()
+
+	stored := []byte{1, 2, 3}
+	tree.Put([]byte{1}, stored)
+
+	value, _ := tree.Remove([]byte{1})
+	stored[0] = 4
+
+	if !bytes.Equal(value, []byte{1, 2, 3}) {
+		t.Fatalf("removed value must be a copy, but got %v", value)
+	}
+}
+
+func TestTruncateToFirst(t *testing.T) {
+	for _, n := range []int{-1, 0, 1, 5, 19, 20, 25} {
+		tree := New()
+		for k := 0; k < 20; k++ {
+			tree.Put([]byte{byte(k)}, []byte{byte(k)})
+		}
+
+		kept := n
+		if kept < 0 {
+			kept = 0
+		} else if kept > 20 {
+			kept = 20
+		}
+
+		if removed := tree.TruncateToFirst(n); removed != 20-kept {
+			t.Fatalf("%d: expected %d removed keys, but got %d", n, 20-kept, removed)
+		}
+		if err := tree.Validate(); err != nil {
+			t.Fatalf("%d: tree is not valid after truncation: %s", n, err)
+		}
+		if tree.Size() != kept {
+			t.Fatalf("%d: expected size %d, but got %d", n, kept, tree.Size())
+		}
+		for k := 0; k < kept; k++ {
+			if _, ok := tree.Get([]byte{byte(k)}); !ok {
+				t.Fatalf("%d: expected key %d to be kept", n, k)
+			}
+		}
+	}
+}
+
+func TestTruncateToFirstWithTombstones(t *testing.T) {
+	tree := NewWithTombstones()
+	for k := 0; k < 10; k++ {
+		tree.Put([]byte{byte(k)}, []byte{byte(k)})
+	}
+	tree.Delete([]byte{1})
+	tree.Delete([]byte{7})
+
+	if removed := tree.TruncateToFirst(3); removed != 5 {
+		t.Fatalf("expected 5 removed keys, but got %d", removed)
+	}
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("tree is not valid after truncation: %s", err)
+	}
+
+	expected := []Entry{{[]byte{0}, []byte{0}}, {[]byte{2}, []byte{2}}, {[]byte{3}, []byte{3}}}
+	if entries := tree.Entries(); !reflect.DeepEqual(expected, entries) {
+		t.Fatalf("expected %v, but got %v", expected, entries)
+	}
+}
+
+func TestTruncateToLast(t *testing.T) {
+	for _, n := range []int{-1, 0, 1, 5, 19, 20, 25} {
+		tree := New()
+		for k := 0; k < 20; k++ {
+			tree.Put([]byte{byte(k)}, []byte{byte(k)})
+		}
+
+		kept := n
+		if kept < 0 {
+			kept = 0
+		} else if kept > 20 {
+			kept = 20
+		}
+
+		if removed := tree.TruncateToLast(n); removed != 20-kept {
+			t.Fatalf("%d: expected %d removed keys, but got %d", n, 20-kept, removed)
+		}
+		if err := tree.Validate(); err != nil {
+			t.Fatalf("%d: tree is not valid after truncation: %s", n, err)
+		}
+		if tree.Size() != kept {
+			t.Fatalf("%d: expected size %d, but got %d", n, kept, tree.Size())
+		}
+		for k := 20 - kept; k < 20; k++ {
+			if _, ok := tree.Get([]byte{byte(k)}); !ok {
+				t.Fatalf("%d: expected key %d to be kept", n, k)
+			}
+		}
+	}
+}
+
+func TestTruncateToLastWithTombstones(t *testing.T) {
+	tree := NewWithTombstones()
+	for k := 0; k < 10; k++ {
+		tree.Put([]byte{byte(k)}, []byte{byte(k)})
+	}
+	tree.Delete([]byte{2})
+	tree.Delete([]byte{8})
+
+	if removed := tree.TruncateToLast(3); removed != 5 {
+		t.Fatalf("expected 5 removed keys, but got %d", removed)
+	}
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("tree is not valid after truncation: %s", err)
+	}
+
+	expected := []Entry{{[]byte{6}, []byte{6}}, {[]byte{7}, []byte{7}}, {[]byte{9}, []byte{9}}}
+	if entries := tree.Entries(); !reflect.DeepEqual(expected, entries) {
+		t.Fatalf("expected %v, but got %v", expected, entries)
+	}
+}
+
+func TestRemoveRange(t *testing.T) {
+	cases := []struct {
+		lo, hi   []byte
+		expected []byte
+	}{
+		{[]byte{3}, []byte{7}, []byte{3, 4, 5, 6}},
+		{[]byte{2, 1}, []byte{4, 1}, []byte{3, 4}},
+		{nil, []byte{3}, []byte{0, 1, 2}},
+		{[]byte{8}, nil, []byte{8, 9}},
+		{nil, nil, []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}},
+		{[]byte{5}, []byte{5}, []byte{}},
+		{[]byte{10}, nil, []byte{}},
+	}
+
+	for _, c := range cases {
+		tree := New()
+		for k := byte(0); k < 10; k++ {
+			tree.Put([]byte{k}, []byte{k * 2})
+		}
+
+		removed := tree.RemoveRange(c.lo, c.hi)
+
+		keys := make([]byte, 0)
+		for _, entry := range removed {
+			if entry.Value[0] != entry.Key[0]*2 {
+				t.Fatalf("expected value %d, but got %d", entry.Key[0]*2, entry.Value[0])
+			}
+			keys = append(keys, entry.Key[0])
+		}
+		if !bytes.Equal(keys, c.expected) {
+			t.Fatalf("[%v, %v): expected removed keys %v, but got %v", c.lo, c.hi, c.expected, keys)
+		}
+
+		if tree.Size() != 10-len(c.expected) {
+			t.Fatalf("expected size %d, but got %d", 10-len(c.expected), tree.Size())
+		}
+		if err := tree.Validate(); err != nil {
+			t.Fatalf("tree is not valid after removal: %s", err)
+		}
+		for _, key := range c.expected {
+			if _, ok := tree.Get([]byte{key}); ok {
+				t.Fatalf("expected key %d to be removed", key)
+			}
+		}
+	}
+}
+
+func TestRangeNodes(t *testing.T) {
+	// keys: 2 3 5 6 7 with tombstoned 0 1 4 8 9
+	tree := tombstonedTree()
+
+	cases := []struct {
+		lo, hi   []byte
+		expected []byte
+	}{
+		{nil, nil, []byte{2, 3, 5, 6, 7}},
+		{[]byte{3}, []byte{6}, []byte{3, 5}},
+		{[]byte{1}, []byte{4}, []byte{2, 3}},
+		{[]byte{4}, []byte{8}, []byte{5, 6, 7}},
+		{[]byte{6}, []byte{3}, []byte{}},
+		{[]byte{5}, []byte{5}, []byte{}},
+		{[]byte{8}, nil, []byte{}},
+		{nil, []byte{1}, []byte{}},
+	}
+
+	for _, c := range cases {
+		actual := make([]byte, 0)
+		tree.rangeNodes(c.lo, c.hi, func(n *node) bool {
+			actual = append(actual, n.key[0])
+			return true
+		})
+
+		if !bytes.Equal(c.expected, actual) {
+			t.Fatalf("[%v, %v): expected %v, but got %v", c.lo, c.hi, c.expected, actual)
+		}
+	}
+
+	visited := 0
+	tree.rangeNodes(nil, nil, func(n *node) bool {
+		visited++
+		return visited < 2
+	})
+	if visited != 2 {
+		t.Fatalf("expected the walk to stop after 2 nodes, but got %d", visited)
+	}
+}
+
+func TestRemoveRangeWithTombstones(t *testing.T) {
+	tree := tombstonedTree()
+	deletions := 0
+	tree.OnChange(func(op Op, key, value []byte) {
+		deletions++
+	})
+
+	removed := tree.RemoveRange([]byte{1}, []byte{5})
+	expected := []Entry{{[]byte{2}, []byte{2}}, {[]byte{3}, []byte{3}}}
+	if !reflect.DeepEqual(expected, removed) || deletions != 2 {
+		t.Fatalf("expected %v, but got %v and %d notifications", expected, removed, deletions)
+	}
+
+	empty := NewWithTombstones()
+	empty.Put([]byte{1}, []byte{1})
+	empty.Delete([]byte{1})
+	if removed := empty.RemoveRange(nil, nil); len(removed) != 0 {
+		t.Fatalf("expected nothing to be removed, but got %v", removed)
+	}
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("tree is not valid after removal: %s", err)
+	}
+}
+
+func TestDeleteFunc(t *testing.T) {
+	tree := New()
+	for k := 0; k < 256; k++ {
+		tree.Put([]byte{byte(k)}, []byte{byte(k)})
+	}
+
+	removed := tree.DeleteFunc(func(key, value []byte) bool {
+		return key[0]%2 == 1
+	})
+	if removed != 128 {
+		t.Fatalf("expected 128 removed entries, but got %d", removed)
+	}
+	if tree.Size() != 128 {
+		t.Fatalf("expected size 128, but got %d", tree.Size())
+	}
+
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("tree is not valid after DeleteFunc: %s", err)
+	}
+
+	tree.ForEach(func(key, value []byte) {
+		if key[0]%2 == 1 {
+			t.Fatalf("key %d must be deleted", key[0])
+		}
+	})
+
+	removed = tree.DeleteFunc(func(key, value []byte) bool {
+		return false
+	})
+	if removed != 0 {
+		t.Fatalf("expected no removed entries, but got %d", removed)
+	}
+}
+
+func TestForEachDeletable(t *testing.T) {
+	for n := 0; n <= 64; n++ {
+		tree := New()
+		for k := 0; k < n; k++ {
+			tree.Put([]byte{byte(k)}, []byte{byte(k)})
+		}
+
+		visited := 0
+		tree.ForEachDeletable(func(key, value []byte) bool {
+			if key[0] != byte(visited) || value[0] != byte(visited) {
+				t.Fatalf("expected key %d, but got %d", visited, key[0])
+			}
+			visited++
+
+			return key[0]%3 != 0
+		})
+
+		if visited != n {
+			t.Fatalf("expected %d visited entries, but got %d", n, visited)
+		}
+		if expected := (n + 2) / 3; tree.Size() != expected {
+			t.Fatalf("expected size %d, but got %d", expected, tree.Size())
+		}
+		if err := tree.Validate(); err != nil {
+			t.Fatalf("tree of size %d is not valid after deletions: %s", n, err)
+		}
+		tree.ForEach(func(key, value []byte) {
+			if key[0]%3 != 0 {
+				t.Fatalf("expected key %d to be deleted", key[0])
+			}
+		})
+	}
+}
+
+func TestDeleteFuncWithTombstones(t *testing.T) {
+	tree := tombstonedTree()
+	deletions := 0
+	tree.OnChange(func(op Op, key, value []byte) {
+		deletions++
+	})
+
+	removed := tree.DeleteFunc(func(key, value []byte) bool {
+		return value[0] != 5
+	})
+	if removed != 4 || deletions != 4 {
+		t.Fatalf("expected 4 removed entries and notifications, but got %d and %d", removed, deletions)
+	}
+	if tree.Size() != 1 {
+		t.Fatalf("expected size 1, but got %d", tree.Size())
+	}
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("tree is not valid after DeleteFunc: %s", err)
+	}
+}
+
+func TestForEachDeletableWithTombstones(t *testing.T) {
+	tree := tombstonedTree()
+	deletions := 0
+	tree.OnChange(func(op Op, key, value []byte) {
+		deletions++
+	})
+
+	keys := make([]byte, 0)
+	tree.ForEachDeletable(func(key, value []byte) bool {
+		keys = append(keys, value[0])
+		return true
+	})
+	if !bytes.Equal(keys, []byte{2, 3, 5, 6, 7}) || deletions != 5 {
+		t.Fatalf("expected keys 2, 3, 5, 6 and 7 to be deleted, but got %v and %d notifications", keys, deletions)
+	}
+	if tree.Size() != 0 {
+		t.Fatalf("expected empty tree, but got size %d", tree.Size())
+	}
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("tree is not valid after deletions: %s", err)
+	}
+}
+
+func TestDeleteFuncForEmptyTree(t *testing.T) {
+	tree := New()
+
+	removed := tree.DeleteFunc(func(key, value []byte) bool {
+		t.Fatal("call is not expected")
+		return true
+	})
+	if removed != 0 {
+		t.Fatalf("expected no removed entries, but got %d", removed)
+	}
+}
+
+func TestFirstAndLast(t *testing.T) {
+	tree := New()
+
+	if _, _, ok := tree.First(); ok {
+		t.Fatal("expected First to report false for the empty tree")
+	}
+	if _, _, ok := tree.Last(); ok {
+		t.Fatal("expected Last to report false for the empty tree")
+	}
+
+	for _, c := range treeCases {
+		tree.Put([]byte{c.key}, []byte(c.value))
+	}
+
+	key, value, ok := tree.First()
+	if !ok || !bytes.Equal(key, []byte{0}) || string(value) != "0" {
+		t.Fatalf("unexpected first entry: %v, %s, %v", key, value, ok)
+	}
+
+	key[0] = 255
+	if _, ok := tree.Get([]byte{0}); !ok {
+		t.Fatal("modifying the returned key must not affect the tree")
+	}
+
+	key, value, ok = tree.Last()
+	if !ok || !bytes.Equal(key, []byte{74}) || string(value) != "74" {
+		t.Fatalf("unexpected last entry: %v, %s, %v", key, value, ok)
+	}
+}
+
+func TestForEach(t *testing.T) {
+	tree := New()
+	for _, c := range treeCases {
+		tree.Put([]byte{c.key}, []byte(c.value))
+	}
+
+	actual := make([]byte, 0)
+	tree.ForEach(func(key []byte, value []byte) {
+		actual = append(actual, key...)
+	})
+
+	isSorted := sort.SliceIsSorted(actual, func(i, j int) bool {
+		return actual[i] < actual[j]
+	})
+	if !isSorted {
+		t.Fatalf("each does not traverse in sorted order, produced result: %s", actual)
+	}
+
+	expected := make([]byte, 0)
+	for _, c := range treeCases {
+		expected = append(expected, c.key)
+	}
+	sort.Slice(expected, func(i, j int) bool {
+		return expected[i] < expected[j]
+	})
+
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("%s != %s", expected, actual)
+	}
+}
+
+func TestForEachForEmptyTree(t *testing.T) {
+	tree := New()
+
+	tree.ForEach(func(key []byte, value []byte) {
+		t.Fatal("call is not expected")
+	})
+}
+
+func TestForEachDoesNotAllocate(t *testing.T) {
+	tree := New()
+	for k := 0; k < 256; k++ {
+		tree.Put([]byte{byte(k)}, []byte{byte(k)})
+	}
+
+	var sum int
+	action := func(key, value []byte) {
+		sum += int(key[0]) + int(value[0])
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		tree.ForEach(action)
+	})
+	if allocs != 0 {
+		t.Fatalf("expected no allocations, but got %v per traversal", allocs)
+	}
+}
+
+func TestForEachWithConcurrentReaders(t *testing.T) {
+	tree := New()
+	for k := 0; k < 256; k++ {
+		tree.Put([]byte{byte(k)}, []byte{byte(k)})
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+
+			count := 0
+			tree.ForEach(func(key, value []byte) {
+				count++
+			})
+			if count != 256 {
+				t.Errorf("expected 256 entries, but got %d", count)
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			for k := 0; k < 256; k++ {
+				if _, ok := tree.Get([]byte{byte(k)}); !ok {
+					t.Errorf("key %d is not found", k)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestPutSequential(t *testing.T) {
+	ascending := New()
+	descending := New()
+	for k := 0; k < 256; k++ {
+		ascending.Put([]byte{byte(k)}, []byte{byte(k)})
+		descending.Put([]byte{byte(255 - k)}, []byte{byte(255 - k)})
+
+		if err := ascending.Validate(); err != nil {
+			t.Fatalf("tree is not valid after ascending insertion of %d: %s", k, err)
+		}
+		if err := descending.Validate(); err != nil {
+			t.Fatalf("tree is not valid after descending insertion of %d: %s", 255-k, err)
+		}
+	}
+
+	for k := 0; k < 256; k++ {
+		prev, exists := ascending.Put([]byte{byte(k)}, []byte{byte(k + 1)})
+		if !exists || !bytes.Equal(prev, []byte{byte(k)}) {
+			t.Fatalf("expected to override key %d, but got %v, %v", k, prev, exists)
+		}
+	}
+
+	if ascending.Size() != 256 {
+		t.Fatalf("expected size 256, but got %d", ascending.Size())
+	}
+}
+
+func TestPutMixedWithDelete(t *testing.T) {
+	random := rand.New(rand.NewSource(7))
+
+	tree := New()
+	for i := 0; i < 4096; i++ {
+		k := []byte{byte(random.Intn(256))}
+		if random.Intn(3) == 0 {
+			tree.Delete(k)
+		} else {
+			tree.Put(k, k)
+		}
+
+		if err := tree.Validate(); err != nil {
+			t.Fatalf("tree is not valid after operation %d: %s", i, err)
+		}
+	}
+}
+
+func TestForEachIndexed(t *testing.T) {
+	tree := New()
+	for _, c := range treeCases {
+		tree.Put([]byte{c.key}, []byte(c.value))
+	}
+
+	expected := make([]byte, 0)
+	for _, c := range treeCases {
+		expected = append(expected, c.key)
+	}
+	sort.Slice(expected, func(i, j int) bool {
+		return expected[i] < expected[j]
+	})
+
+	calls := 0
+	tree.ForEachIndexed(func(index int, key, value []byte) {
+		if index != calls {
+			t.Fatalf("expected index %d, but got %d", calls, index)
+		}
+		if key[0] != expected[index] {
+			t.Fatalf("expected key %d at index %d, but got %d", expected[index], index, key[0])
+		}
+		calls++
+	})
+
+	if calls != len(expected) {
+		t.Fatalf("expected %d calls, but got %d", len(expected), calls)
+	}
+}
+
+func TestForEachIndexedForEmptyTree(t *testing.T) {
+	tree := New()
+
+	tree.ForEachIndexed(func(index int, key, value []byte) {
+		t.Fatal("call is not expected")
+	})
+}
+
+func TestForEachKey(t *testing.T) {
+	tree := NewWithValueLoader(func(key []byte) ([]byte, bool) {
+		t.Fatal("loader call is not expected")
+		return nil, false
+	})
+	tree.ForEachKey(func(key []byte) {
+		t.Fatal("call is not expected")
+	})
+
+	for _, c := range treeCases {
+		tree.Put([]byte{c.key}, nil)
+	}
+
+	keys := make([]byte, 0)
+	tree.ForEachKey(func(key []byte) {
+		keys = append(keys, key[0])
+	})
+
+	if len(keys) != tree.Size() {
+		t.Fatalf("expected %d keys, but got %d", tree.Size(), len(keys))
+	}
+	if !sort.SliceIsSorted(keys, func(i, j int) bool { return keys[i] < keys[j] }) {
+		t.Fatalf("expected keys in ascending order, but got %v", keys)
+	}
+}
+
+func TestForEachWithProgress(t *testing.T) {
+	tree := New()
+	tree.ForEachWithProgress(func(index, total int, key, value []byte) {
+		t.Fatal("call is not expected")
+	})
+
+	for _, c := range treeCases {
+		tree.Put([]byte{c.key}, []byte(c.value))
+	}
+
+	calls := 0
+	var prev []byte
+	tree.ForEachWithProgress(func(index, total int, key, value []byte) {
+		if index != calls {
+			t.Fatalf("expected index %d, but got %d", calls, index)
+		}
+		if total != tree.Size() {
+			t.Fatalf("expected total %d, but got %d", tree.Size(), total)
+		}
+		if prev != nil && bytes.Compare(prev, key) >= 0 {
+			t.Fatalf("expected ascending order, but got %v after %v", key, prev)
+		}
+		prev = key
+		calls++
+	})
+
+	if calls != tree.Size() {
+		t.Fatalf("expected %d calls, but got %d", tree.Size(), calls)
+	}
+}
+
+func TestForEachWithProgressForMultiTree(t *testing.T) {
+	tree := NewMultiTree()
+	tree.Put([]byte{1}, []byte{1})
+	tree.Put([]byte{1}, []byte{2})
+	tree.Put([]byte{2}, []byte{3})
+
+	calls := 0
+	tree.ForEachWithProgress(func(index, total int, key, value []byte) {
+		if total != 3 {
+			t.Fatalf("expected total 3, but got %d", total)
+		}
+		if index != calls || value[0] != byte(index+1) {
+			t.Fatalf("expected index %d with value %d, but got %d with %v", calls, calls+1, index, value)
+		}
+		calls++
+	})
+
+	if calls != 3 {
+		t.Fatalf("expected 3 calls, but got %d", calls)
+	}
+}
+
+func TestEnsureBalanced(t *testing.T) {
+	tree := New()
+	if tree.EnsureBalanced(0) {
+		t.Fatal("expected no rebuild for the empty tree")
+	}
+
+	for k := 0; k < 100; k++ {
+		tree.Put([]byte{byte(k)}, []byte{byte(k)})
+	}
+	if tree.EnsureBalanced(2) {
+		t.Fatal("expected no rebuild for a valid tree")
+	}
+
+	// degenerate the tree into a chain of the right children
+	var root, parent *node
+	tree.ForEach(func(key, value []byte) {
+		n := &node{key: key, value: value, parent: parent, color: black}
+		if parent == nil {
+			root = n
+		} else {
+			parent.right = n
+		}
+		parent = n
+	})
+	for n := parent; n != nil; n = n.parent {
+		n.size = sizeOf(n.right) + 1
+	}
+	tree.setRoot(root)
+
+	if !tree.EnsureBalanced(2) {
+		t.Fatal("expected rebuild for the degenerate tree")
+	}
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("tree is not valid after rebuild: %s", err)
+	}
+	if tree.Size() != 100 {
+		t.Fatalf("expected size 100, but got %d", tree.Size())
+	}
+	if tree.EnsureBalanced(2) {
+		t.Fatal("expected no rebuild for the rebuilt tree")
+	}
+}
+
+func TestForEachWithKeyLen(t *testing.T) {
+	tree := New()
+	keys := []string{"a", "ab", "abc", "b", "bc", "c", "cde", ""}
+	for _, key := range keys {
+		tree.Put([]byte(key), []byte(key))
+	}
+
+	cases := []struct {
+		n        int
+		expected []string
+	}{
+		{0, []string{""}},
+		{1, []string{"a", "b", "c"}},
+		{2, []string{"ab", "bc"}},
+		{3, []string{"abc", "cde"}},
+		{4, []string{}},
+	}
+
+	for _, c := range cases {
+		actual := make([]string, 0)
+		tree.ForEachWithKeyLen(c.n, func(key, value []byte) {
+			if !bytes.Equal(key, value) {
+				t.Fatalf("expected value %s, but got %s", key, value)
+			}
+			actual = append(actual, string(key))
+		})
+
+		if !reflect.DeepEqual(c.expected, actual) {
+			t.Fatalf("%d: expected %v, but got %v", c.n, c.expected, actual)
+		}
+	}
+}
+
+func TestMaxByAndMinBy(t *testing.T) {
+	less := func(a, b []byte) bool {
+		return bytes.Compare(a, b) < 0
+	}
+
+	tree := New()
+	if _, _, ok := tree.MaxBy(less); ok {
+		t.Fatal("expected not found for empty tree")
+	}
+	if _, _, ok := tree.MinBy(less); ok {
+		t.Fatal("expected not found for empty tree")
+	}
+
+	values := []byte{5, 9, 1, 9, 3, 1, 7}
+	for k, v := range values {
+		tree.Put([]byte{byte(k)}, []byte{v})
+	}
+
+	key, value, ok := tree.MaxBy(less)
+	if !ok || !bytes.Equal(key, []byte{1}) || !bytes.Equal(value, []byte{9}) {
+		t.Fatalf("expected key 1 with value 9, but got %v, %v, %v", key, value, ok)
+	}
+
+	key, value, ok = tree.MinBy(less)
+	if !ok || !bytes.Equal(key, []byte{2}) || !bytes.Equal(value, []byte{1}) {
+		t.Fatalf("expected key 2 with value 1, but got %v, %v, %v", key, value, ok)
+	}
+
+	key[0] = 100
+	if _, ok := tree.Get([]byte{2}); !ok {
+		t.Fatal("expected the key to be copied")
+	}
+}
+
+func TestReplaceAll(t *testing.T) {
+	tree := New()
+	for k := 0; k < 10; k++ {
+		tree.Put([]byte{byte(k)}, []byte{byte(k)})
+	}
+
+	ops := make([]Op, 0)
+	tree.OnChange(func(op Op, key, value []byte) {
+		if tree.Size() != 3 {
+			t.Fatalf("expected the tree to be replaced before the notification, but got size %d", tree.Size())
+		}
+		ops = append(ops, op)
+	})
+
+	pairs := []Entry{{[]byte{20}, []byte{1}}, {[]byte{21}, []byte{2}}, {[]byte{22}, []byte{3}}}
+	if err := tree.ReplaceAll(pairs); err != nil {
+		t.Fatalf("failed to replace: %s", err)
+	}
+
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("tree is not valid after replacement: %s", err)
+	}
+	if !reflect.DeepEqual(tree.Entries(), pairs) {
+		t.Fatalf("expected %v, but got %v", pairs, tree.Entries())
+	}
+	if len(ops) != 13 {
+		t.Fatalf("expected 13 notifications, but got %d", len(ops))
+	}
+	tree.OnChange(nil)
+
+	pairs[0].Key[0] = 30
+	if _, ok := tree.Get([]byte{20}); !ok {
+		t.Fatal("expected the keys to be copied")
+	}
+
+	if err := tree.ReplaceAll([]Entry{{[]byte{2}, nil}, {[]byte{1}, nil}}); err == nil {
+		t.Fatal("expected error for unsorted pairs")
+	}
+	if err := tree.ReplaceAll([]Entry{{[]byte{1}, nil}, {[]byte{1}, nil}}); err == nil {
+		t.Fatal("expected error for duplicate keys")
+	}
+	if tree.Size() != 3 {
+		t.Fatal("failed replacement must not modify the tree")
+	}
+
+	if err := tree.ReplaceAll(nil); err != nil || tree.Size() != 0 {
+		t.Fatalf("expected empty tree, but got size %d and error %v", tree.Size(), err)
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	for n := 0; n <= 64; n++ {
+		tree := New()
+		for k := n; k > 0; k-- {
+			tree.Put([]byte{byte(k)}, []byte{byte(k)})
+		}
+
+		before := make([]byte, 0)
+		tree.ForEach(func(key, value []byte) {
+			before = append(before, key[0], value[0])
+		})
+
+		tree.Rebuild()
+
+		if err := tree.Validate(); err != nil {
+			t.Fatalf("tree of size %d is not valid after rebuild: %s", n, err)
+		}
+		if tree.Size() != n {
+			t.Fatalf("expected size %d after rebuild, but got %d", n, tree.Size())
+		}
+
+		after := make([]byte, 0)
+		tree.ForEach(func(key, value []byte) {
+			after = append(after, key[0], value[0])
+		})
+		if !reflect.DeepEqual(before, after) {
+			t.Fatalf("entries changed after rebuild: %v != %v", before, after)
+		}
+
+		h := height(tree.root)
+		max := int(math.Ceil(math.Log2(float64(n + 1))))
+		if h != max {
+			t.Fatalf("tree of size %d is not perfectly balanced: h=%d, expected %d", n, h, max)
+		}
+	}
+}
+
+func TestForEachMutable(t *testing.T) {
+	tree := New()
+	for _, c := range treeCases {
+		tree.Put([]byte{c.key}, []byte{c.key})
+	}
+
+	tree.ForEachMutable(func(key []byte, value *[]byte) {
+		*value = append(*value, key[0])
+	})
+
+	for _, c := range treeCases {
+		value, _ := tree.Get([]byte{c.key})
+		if !bytes.Equal(value, []byte{c.key, c.key}) {
+			t.Fatalf("expected value %v for key %d, but got %v", []byte{c.key, c.key}, c.key, value)
+		}
+	}
+}
+
+func TestForEachMutableForEmptyTree(t *testing.T) {
+	tree := New()
+
+	tree.ForEachMutable(func(key []byte, value *[]byte) {
+		t.Fatal("call is not expected")
+	})
+}
+
+func TestTransformValues(t *testing.T) {
+	tree := New()
+	for _, c := range treeCases {
+		tree.Put([]byte{c.key}, []byte(c.value))
+	}
+
+	tree.TransformValues(func(key, value []byte) []byte {
+		switch {
+		case key[0] == 0:
+			return nil
+		case key[0] < 20:
+			return append([]byte("v"), value...)
+		default:
+			return value
+		}
+	})
+
+	for _, c := range treeCases {
+		expected := c.value
+		if c.key < 20 {
+			expected = "v" + c.value
+		}
+		if c.key == 0 {
+			expected = ""
+		}
+
+		value, _ := tree.Get([]byte{c.key})
+		if string(value) != expected {
+			t.Fatalf("expected value %s for key %d, but got %s", expected, c.key, value)
+		}
+		if value == nil {
+			t.Fatalf("expected non-nil value for key %d", c.key)
+		}
+	}
+}
+
+func TestColorCounts(t *testing.T) {
+	if red, black := New().ColorCounts(); red != 0 || black != 0 {
+		t.Fatalf("expected 0 and 0 for the empty tree, but got %d and %d", red, black)
+	}
+
+	tree := buildTreeFromSpec(blackSpec(10, redSpec(5, blackSpec(3, nil, nil), blackSpec(7, nil, nil)), blackSpec(15, nil, nil)))
+	if red, black := tree.ColorCounts(); red != 1 || black != 4 {
+		t.Fatalf("expected 1 and 4, but got %d and %d", red, black)
+	}
+}
+
+func TestForEachLevel(t *testing.T) {
+	tree := New()
+
+	tree.ForEachLevel(func(level int, key, value []byte, isBlack bool) {
+		t.Fatal("call is not expected")
+	})
+
+	tree = buildTreeFromSpec(blackSpec(10, redSpec(5, blackSpec(3, nil, nil), blackSpec(7, nil, nil)), blackSpec(15, nil, nil)))
+	before := shape(tree.root)
+
+	visited := make([]string, 0)
+	tree.ForEachLevel(func(level int, key, value []byte, isBlack bool) {
+		color := "R"
+		if isBlack {
+			color = "B"
+		}
+		visited = append(visited, fmt.Sprintf("%d:%d%s", level, key[0], color))
+	})
+
+	expected := []string{"0:10B", "1:5R", "1:15B", "2:3B", "2:7B"}
+	if !reflect.DeepEqual(visited, expected) {
+		t.Fatalf("expected %v, but got %v", expected, visited)
+	}
+	if shape(tree.root) != before {
+		t.Fatal("ForEachLevel must not modify the tree")
+	}
+}
+
+func TestForEachNode(t *testing.T) {
+	tree := New()
+
+	tree.ForEachNode(func(key, value []byte, isBlack bool, depth int) {
+		t.Fatal("call is not expected")
+	})
+
+	for _, c := range treeCases {
+		tree.Put([]byte{c.key}, []byte(c.value))
+	}
+
+	before := shape(tree.root)
+
+	keys := make([]byte, 0)
+	tree.ForEachNode(func(key, value []byte, isBlack bool, depth int) {
+		keys = append(keys, key[0])
+
+		n := tree.getNode(key)
+		if isBlack != (n.color == black) {
+			t.Fatalf("wrong color reported for key %d", key[0])
+		}
+
+		if expected, _ := tree.Depth(key); depth != expected {
+			t.Fatalf("expected depth %d for key %d, but got %d", expected, key[0], depth)
+		}
+
+		if string(value) != string(n.value) {
+			t.Fatalf("expected value %s for key %d, but got %s", n.value, key[0], value)
+		}
+	})
+
+	expected := make([]byte, 0)
+	tree.ForEach(func(key, value []byte) {
+		expected = append(expected, key[0])
+	})
+	if !reflect.DeepEqual(expected, keys) {
+		t.Fatalf("%v != %v", expected, keys)
+	}
+
+	if after := shape(tree.root); before != after {
+		t.Fatalf("tree must not be modified: %s != %s", before, after)
+	}
+}
+
+func TestRangeLimit(t *testing.T) {
+	tree := New()
+	for _, c := range treeCases {
+		tree.Put([]byte{c.key}, []byte(c.value))
+	}
+
+	cases := []struct {
+		start    byte
+		limit    int
+		expected []byte
+	}{
+		{0, 3, []byte{0, 1, 2}},
+		{3, 3, []byte{7, 11, 14}},
+		{14, 2, []byte{14, 15}},
+		{60, 5, []byte{60, 74}},
+		{75, 5, []byte{}},
+		{0, 0, []byte{}},
+		{0, -1, []byte{}},
+	}
+
+	for _, c := range cases {
+		actual := make([]byte, 0)
+		visited := tree.RangeLimit([]byte{c.start}, c.limit, func(key, value []byte) {
+			actual = append(actual, key[0])
+		})
+
+		if !reflect.DeepEqual(c.expected, actual) {
+			t.Fatalf("start=%d, limit=%d: %v != %v", c.start, c.limit, c.expected, actual)
+		}
+		if visited != len(c.expected) {
+			t.Fatalf("start=%d, limit=%d: expected %d visited entries, but got %d", c.start, c.limit, len(c.expected), visited)
+		}
+	}
+}
+
+func TestRangeLimitForMultiTree(t *testing.T) {
+	tree := NewMultiTree()
+	tree.Put([]byte{1}, []byte{10})
+	tree.Put([]byte{1}, []byte{11})
+	tree.Put([]byte{1}, []byte{12})
+	tree.Put([]byte{2}, []byte{20})
+
+	cases := []struct {
+		limit    int
+		expected []byte
+	}{
+		{2, []byte{10, 11}},
+		{3, []byte{10, 11, 12}},
+		{10, []byte{10, 11, 12, 20}},
+	}
+
+	for _, c := range cases {
+		actual := make([]byte, 0)
+		visited := tree.RangeLimit(nil, c.limit, func(key, value []byte) {
+			actual = append(actual, value[0])
+		})
+
+		if !reflect.DeepEqual(c.expected, actual) || visited != len(c.expected) {
+			t.Fatalf("limit=%d: expected %v, but got %v and %d visited entries", c.limit, c.expected, actual, visited)
+		}
+	}
+}
+
+func TestRangeReverseForMultiTree(t *testing.T) {
+	tree := NewMultiTree()
+	tree.Put([]byte{1}, []byte{10})
+	tree.Put([]byte{2}, []byte{20})
+	tree.Put([]byte{1}, []byte{11})
+	tree.Put([]byte{2}, []byte{21})
+
+	actual := make([]byte, 0)
+	tree.RangeReverse(nil, nil, func(key, value []byte) {
+		actual = append(actual, value[0])
+	})
+
+	if expected := []byte{20, 21, 10, 11}; !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected %v, but got %v", expected, actual)
+	}
+}
+
+func TestRangeReverse(t *testing.T) {
+	tree := New()
+
+	tree.RangeReverse(nil, nil, func(key, value []byte) {
+		t.Fatal("call is not expected")
+	})
+
+	// keys: 0 1 2 7 11 14 15 16 18 25 33 42 60 74
+	for _, c := range treeCases {
+		tree.Put([]byte{c.key}, []byte(c.value))
+	}
+
+	cases := []struct {
+		lo       []byte
+		hi       []byte
+		expected []byte
+	}{
+		{[]byte{7}, []byte{16}, []byte{15, 14, 11, 7}},
+		{[]byte{8}, []byte{15}, []byte{14, 11}},
+		{nil, []byte{7}, []byte{2, 1, 0}},
+		{[]byte{42}, nil, []byte{74, 60, 42}},
+		{nil, nil, []byte{74, 60, 42, 33, 25, 18, 16, 15, 14, 11, 7, 2, 1, 0}},
+		{[]byte{16}, []byte{7}, []byte{}},
+		{[]byte{16}, []byte{16}, []byte{}},
+		{[]byte{75}, nil, []byte{}},
+	}
+
+	for _, c := range cases {
+		actual := make([]byte, 0)
+		tree.RangeReverse(c.lo, c.hi, func(key, value []byte) {
+			actual = append(actual, key[0])
+		})
+
+		if !reflect.DeepEqual(c.expected, actual) {
+			t.Fatalf("[%v, %v): %v != %v", c.lo, c.hi, c.expected, actual)
+		}
+	}
+}
+
+func TestIndexOf(t *testing.T) {
+	tree := New()
+	if _, ok := tree.IndexOf([]byte{1}); ok {
+		t.Fatal("expected false for the empty tree")
+	}
+
+	for k := 0; k < 50; k++ {
+		tree.Put([]byte{byte(k * 2)}, nil)
+	}
+
+	for k := 0; k < 100; k++ {
+		index, ok := tree.IndexOf([]byte{byte(k)})
+		if ok != (k%2 == 0) {
+			t.Fatalf("key %d: expected found %v, but got %v", k, k%2 == 0, ok)
+		}
+		if ok && index != k/2 {
+			t.Fatalf("key %d: expected index %d, but got %d", k, k/2, index)
+		}
+	}
+}
+
+func TestFloorIndexAndCeilingIndex(t *testing.T) {
+	tree := New()
+
+	if _, ok := tree.FloorIndex([]byte{1}); ok {
+		t.Fatal("expected FloorIndex to report false for the empty tree")
+	}
+	if _, ok := tree.CeilingIndex([]byte{1}); ok {
+		t.Fatal("expected CeilingIndex to report false for the empty tree")
+	}
+
+	// keys: 0 1 2 7 11 14 15 16 18 25 33 42 60 74
+	for _, c := range treeCases {
+		tree.Put([]byte{c.key}, []byte(c.value))
+	}
+
+	cases := []struct {
+		key          byte
+		floor        int
+		floorFound   bool
+		ceiling      int
+		ceilingFound bool
+	}{
+		{0, 0, true, 0, true},
+		{3, 2, true, 3, true},
+		{11, 4, true, 4, true},
+		{17, 7, true, 8, true},
+		{74, 13, true, 13, true},
+		{75, 13, true, 0, false},
+	}
+
+	for _, c := range cases {
+		floor, ok := tree.FloorIndex([]byte{c.key})
+		if floor != c.floor || ok != c.floorFound {
+			t.Fatalf("key %d: expected floor index %d, %v, but got %d, %v", c.key, c.floor, c.floorFound, floor, ok)
+		}
+
+		ceiling, ok := tree.CeilingIndex([]byte{c.key})
+		if ceiling != c.ceiling || ok != c.ceilingFound {
+			t.Fatalf("key %d: expected ceiling index %d, %v, but got %d, %v", c.key, c.ceiling, c.ceilingFound, ceiling, ok)
+		}
+	}
+
+	tree.Delete([]byte{1})
+
+	if floor, _ := tree.FloorIndex([]byte{3}); floor != 1 {
+		t.Fatalf("expected floor index 1 after deletion, but got %d", floor)
+	}
+
+	if _, ok := tree.FloorIndex(nil); ok {
+		t.Fatal("expected FloorIndex to report false for the key less than all keys")
+	}
+}
+
+func TestPath(t *testing.T) {
+	tree := New()
+
+	if path := tree.Path([]byte{1}); path != nil {
+		t.Fatalf("expected nil path for the empty tree, but got %v", path)
+	}
+
+	for _, c := range treeCases {
+		tree.Put([]byte{c.key}, []byte(c.value))
+	}
+
+	for _, c := range treeCases {
+		path := tree.Path([]byte{c.key})
+		if len(path) == 0 {
+			t.Fatalf("expected path for key %d", c.key)
+		}
+
+		if !bytes.Equal(path[0], []byte{c.key}) {
+			t.Fatalf("path for key %d must start with the key, but got %v", c.key, path[0])
+		}
+		if !bytes.Equal(path[len(path)-1], tree.root.key) {
+			t.Fatalf("path for key %d must end with the root key, but got %v", c.key, path[len(path)-1])
+		}
+
+		current := tree.root
+		for i := len(path) - 1; i >= 0; i-- {
+			if current == nil || !bytes.Equal(current.key, path[i]) {
+				t.Fatalf("path %v for key %d does not follow the tree structure", path, c.key)
+			}
+
+			if bytes.Compare([]byte{c.key}, current.key) < 0 {
+				current = current.left
+			} else {
+				current = current.right
+			}
+		}
+	}
+
+	if path := tree.Path([]byte{230}); path != nil {
+		t.Fatalf("expected nil path for the non-existent key, but got %v", path)
+	}
+}
+
+func TestLongestPrefixMatch(t *testing.T) {
+	tree := New()
+
+	if _, _, ok := tree.LongestPrefixMatch([]byte("a")); ok {
+		t.Fatal("expected false for the empty tree")
+	}
+
+	for _, key := range []string{"10", "10.1", "10.1.2", "10.2", "10.15", "192.168", "3"} {
+		tree.Put([]byte(key), []byte("route "+key))
+	}
+
+	cases := []struct {
+		query    string
+		expected string
+		found    bool
+	}{
+		{"10.1.2.3", "10.1.2", true},
+		{"10.1.3", "10.1", true},
+		{"10.1", "10.1", true},
+		{"10.16", "10.1", true},
+		{"10.14", "10.1", true},
+		{"10.3", "10", true},
+		{"10", "10", true},
+		{"192.168.0.1", "192.168", true},
+		{"192.169", "", false},
+		{"1", "", false},
+		{"2", "", false},
+		{"35", "3", true},
+		{"", "", false},
+	}
+
+	for _, c := range cases {
+		key, value, ok := tree.LongestPrefixMatch([]byte(c.query))
+		if ok != c.found || string(key) != c.expected {
+			t.Fatalf("query %s: expected %s, %v, but got %s, %v", c.query, c.expected, c.found, key, ok)
+		}
+
+		if ok && string(value) != "route "+c.expected {
+			t.Fatalf("query %s: expected value route %s, but got %s", c.query, c.expected, value)
+		}
+	}
+
+	tree.Put(nil, []byte("default"))
+	if key, _, ok := tree.LongestPrefixMatch([]byte("2")); !ok || len(key) != 0 {
+		t.Fatalf("expected the empty key to match, but got %v, %v", key, ok)
+	}
+}
+
+func TestClosestUint64(t *testing.T) {
+	tree := New()
+	if _, _, ok := tree.ClosestUint64(1); ok {
+		t.Fatal("expected false for the empty tree")
+	}
+
+	for _, k := range []uint64{10, 20, 40, math.MaxUint64} {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, k)
+		tree.Put(key, []byte(strconv.FormatUint(k, 10)))
+	}
+
+	cases := []struct {
+		target, expected uint64
+	}{
+		{0, 10},
+		{10, 10},
+		{14, 10},
+		{15, 10},
+		{16, 20},
+		{30, 20},
+		{31, 40},
+		{1000, 40},
+		{math.MaxUint64 - 1, math.MaxUint64},
+	}
+
+	for _, c := range cases {
+		key, value, ok := tree.ClosestUint64(c.target)
+		if !ok || binary.BigEndian.Uint64(key) != c.expected {
+			t.Fatalf("target %d: expected %d, but got %v, %v", c.target, c.expected, key, ok)
+		}
+		if string(value) != strconv.FormatUint(c.expected, 10) {
+			t.Fatalf("target %d: expected value %d, but got %s", c.target, c.expected, value)
+		}
+	}
+}
+
+func TestWithinHamming(t *testing.T) {
+	tree := New()
+	keys := make([][]byte, 0)
+	for a := byte(0); a < 6; a++ {
+		for b := byte(0); b < 6; b++ {
+			keys = append(keys, []byte{a}, []byte{a, b}, []byte{a, b, 0}, []byte{a, b, 1, 2})
+		}
+	}
+	keys = append(keys, nil, []byte{255, 255}, []byte{255, 255, 255})
+	for _, key := range keys {
+		tree.Put(key, key)
+	}
+
+	hamming := func(a, b []byte) int {
+		distance := 0
+		for i := range a {
+			if a[i] != b[i] {
+				distance++
+			}
+		}
+
+		return distance
+	}
+
+	targets := [][]byte{{2, 3}, {2, 3, 0}, {9, 9}, {255, 255}, {1}, {}, {2, 3, 1, 1}}
+	for _, target := range targets {
+		for d := -1; d <= 4; d++ {
+			expected := make([]string, 0)
+			tree.ForEach(func(key, value []byte) {
+				if len(key) == len(target) && d >= 0 && hamming(key, target) <= d {
+					expected = append(expected, string(key))
+				}
+			})
+
+			actual := make([]string, 0)
+			tree.WithinHamming(target, d, func(key, value []byte) {
+				if !bytes.Equal(key, value) {
+					t.Fatalf("expected value %v, but got %v", key, value)
+				}
+				actual = append(actual, string(key))
+			})
+
+			if !reflect.DeepEqual(expected, actual) {
+				t.Fatalf("target %v within %d: expected %q, but got %q", target, d, expected, actual)
+			}
+		}
+	}
+}
+
+func TestPathLengths(t *testing.T) {
+	tree := New()
+	if min, max := tree.PathLengths(); min != 0 || max != 0 {
+		t.Fatalf("expected 0 and 0 for the empty tree, but got %d and %d", min, max)
+	}
+
+	tree.Put([]byte{2}, nil)
+	if min, max := tree.PathLengths(); min != 1 || max != 1 {
+		t.Fatalf("expected 1 and 1, but got %d and %d", min, max)
+	}
+
+	tree.Put([]byte{1}, nil)
+	if min, max := tree.PathLengths(); min != 1 || max != 2 {
+		t.Fatalf("expected 1 and 2, but got %d and %d", min, max)
+	}
+
+	for k := 3; k < 200; k++ {
+		tree.Put([]byte{byte(k)}, nil)
+
+		min, max := tree.PathLengths()
+		if max != height(tree.root) {
+			t.Fatalf("expected max %d, but got %d", height(tree.root), max)
+		}
+		if max > 2*min {
+			t.Fatalf("expected max %d to be at most twice min %d", max, min)
+		}
+	}
+}
+
+func TestDepth(t *testing.T) {
+	tree := New()
+
+	if _, ok := tree.Depth([]byte{1}); ok {
+		t.Fatal("expected false for the empty tree")
+	}
+
+	for _, c := range treeCases {
+		tree.Put([]byte{c.key}, []byte(c.value))
+	}
+
+	if depth, ok := tree.Depth(tree.root.key); depth != 0 || !ok {
+		t.Fatalf("expected 0 and true for the root key, but got %d, %v", depth, ok)
+	}
+
+	for _, c := range treeCases {
+		depth, ok := tree.Depth([]byte{c.key})
+		if !ok {
+			t.Fatalf("key %d must be found", c.key)
+		}
+
+		if expected := len(tree.Path([]byte{c.key})) - 1; depth != expected {
+			t.Fatalf("expected depth %d for key %d, but got %d", expected, c.key, depth)
+		}
+	}
+
+	if depth, ok := tree.Depth([]byte{230}); depth != 0 || ok {
+		t.Fatalf("expected 0 and false for the non-existent key, but got %d, %v", depth, ok)
+	}
+}
+
+func TestCountByPrefixes(t *testing.T) {
+	tree := New()
+	for _, key := range []string{"a", "ab", "abc", "abd", "b", "ba", "c"} {
+		tree.Put([]byte(key), nil)
+	}
+
+	prefixes := [][]byte{[]byte("ab"), []byte("a"), []byte("b"), []byte("d"), []byte("abc"), nil}
+	expected := []int{3, 4, 2, 0, 1, 7}
+
+	actual := tree.CountByPrefixes(prefixes)
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("%v != %v", expected, actual)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	tree := New()
+	for k := 0; k < 256; k++ {
+		tree.Put([]byte{byte(k)}, []byte{byte(k)})
+	}
+
+	filtered := tree.Filter(func(key, value []byte) bool {
+		return key[0]%3 == 0
+	})
+
+	if err := filtered.Validate(); err != nil {
+		t.Fatalf("filtered tree is not valid: %s", err)
+	}
+	if filtered.Size() != 86 {
+		t.Fatalf("expected size 86, but got %d", filtered.Size())
+	}
+
+	filtered.ForEach(func(key, value []byte) {
+		if key[0]%3 != 0 {
+			t.Fatalf("key %d must be filtered out", key[0])
+		}
+	})
+
+	filtered.Put([]byte{1}, nil)
+	filtered.ForEachMutable(func(key []byte, value *[]byte) {
+		if len(*value) > 0 {
+			(*value)[0] = 255
+		}
+	})
+
+	if tree.Size() != 256 {
+		t.Fatalf("source tree must not be modified, but got size %d", tree.Size())
+	}
+	if value, _ := tree.Get([]byte{3}); !bytes.Equal(value, []byte{3}) {
+		t.Fatalf("source values must not be modified, but got %v", value)
+	}
+
+	empty := New().Filter(func(key, value []byte) bool {
+		return true
+	})
+	if empty.Size() != 0 {
+		t.Fatalf("expected empty tree, but got size %d", empty.Size())
+	}
+}
+
+func TestMapValues(t *testing.T) {
+	tree := New()
+	for _, c := range treeCases {
+		tree.Put([]byte{c.key}, []byte(c.value))
+	}
+
+	shared := []byte("shared")
+	mapped := tree.MapValues(func(key, value []byte) []byte {
+		if key[0] == 0 {
+			return shared
 		}
+
+		return append([]byte("v"), value...)
+	})
+
+	if err := mapped.Validate(); err != nil {
+		t.Fatalf("mapped tree is not valid: %s", err)
 	}
+	if mapped.Size() != tree.Size() {
+		t.Fatalf("expected size %d, but got %d", tree.Size(), mapped.Size())
+	}
+
+	shared[0] = 'x'
 
 	for _, c := range treeCases {
-		value, ok := tree.Get([]byte{c.key})
-		if !ok {
-			t.Fatalf("failed to get value by key %d", c.key)
+		expected := "v" + c.value
+		if c.key == 0 {
+			expected = "shared"
+		}
+
+		value, _ := mapped.Get([]byte{c.key})
+		if string(value) != expected {
+			t.Fatalf("expected value %s for key %d, but got %s", expected, c.key, value)
 		}
 
+		value, _ = tree.Get([]byte{c.key})
 		if string(value) != c.value {
-			t.Fatalf("expected to get value %s fo key %d, but got %s", c.value, c.key, string(value))
+			t.Fatalf("source value must not be modified, but got %s", value)
 		}
 	}
 }
 
-func TestSize(t *testing.T) {
+func TestByteSize(t *testing.T) {
 	tree := New()
+	if keyBytes, valueBytes := tree.ByteSize(); keyBytes != 0 || valueBytes != 0 {
+		t.Fatalf("expected 0 and 0, but got %d and %d", keyBytes, valueBytes)
+	}
 
-	expected := 0
-	for _, c := range treeCases {
-		if expected != tree.Size() {
-			t.Fatalf("actual size %d is not equal to expected size %d", tree.Size(), expected)
+	tree.Put([]byte("a"), []byte("value"))
+	tree.Put([]byte("bcd"), nil)
+	tree.Put([]byte("ef"), []byte("xy"))
+	if keyBytes, valueBytes := tree.ByteSize(); keyBytes != 6 || valueBytes != 7 {
+		t.Fatalf("expected 6 and 7, but got %d and %d", keyBytes, valueBytes)
+	}
+
+	multi := NewMultiTree()
+	multi.Put([]byte("ab"), []byte("1"))
+	multi.Put([]byte("ab"), []byte("234"))
+	if keyBytes, valueBytes := multi.ByteSize(); keyBytes != 2 || valueBytes != 4 {
+		t.Fatalf("expected 2 and 4, but got %d and %d", keyBytes, valueBytes)
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	cases := []struct {
+		prefix   []byte
+		expected []byte
+	}{
+		{[]byte("abc"), []byte("abd")},
+		{[]byte{1, 0xff}, []byte{2}},
+		{[]byte{1, 0xff, 0xff}, []byte{2}},
+		{[]byte{0xfe}, []byte{0xff}},
+		{[]byte{0xff, 0xff}, nil},
+		{[]byte{}, nil},
+		{nil, nil},
+	}
+
+	for _, c := range cases {
+		actual := PrefixEnd(c.prefix)
+		if !bytes.Equal(c.expected, actual) || (c.expected == nil) != (actual == nil) {
+			t.Fatalf("prefix %v: expected %v, but got %v", c.prefix, c.expected, actual)
 		}
+	}
 
-		tree.Put([]byte{c.key}, []byte(c.value))
-		expected++
+	prefix := []byte("ab")
+	PrefixEnd(prefix)
+	if string(prefix) != "ab" {
+		t.Fatalf("prefix must not be modified, but got %s", prefix)
 	}
 }
 
-func TestNil(t *testing.T) {
+func TestSingleByteBitmap(t *testing.T) {
 	tree := New()
 
-	tree.Put(nil, []byte{1})
+	bitmap, ok := tree.SingleByteBitmap()
+	if !ok || bitmap != [32]byte{} {
+		t.Fatalf("expected empty bitmap and true for the empty tree, but got %v, %v", bitmap, ok)
+	}
 
-	_, ok := tree.Get(nil)
+	for _, c := range treeCases {
+		tree.Put([]byte{c.key}, []byte(c.value))
+	}
+
+	bitmap, ok = tree.SingleByteBitmap()
 	if !ok {
-		t.Fatalf("key nil is not found")
+		t.Fatal("expected true for the single-byte keys")
+	}
+
+	present := make(map[byte]bool)
+	for _, c := range treeCases {
+		present[c.key] = true
+	}
+
+	for k := 0; k < 256; k++ {
+		if isSet := bitmap[k/8]&(1<<(k%8)) != 0; isSet != present[byte(k)] {
+			t.Fatalf("expected bit %d to be %v, but got %v", k, present[byte(k)], isSet)
+		}
+	}
+
+	tree.Put([]byte{1, 2}, nil)
+
+	if bitmap, ok = tree.SingleByteBitmap(); ok || bitmap != [32]byte{} {
+		t.Fatalf("expected empty bitmap and false for the multi-byte key, but got %v, %v", bitmap, ok)
 	}
 }
 
-func TestPutOverrides(t *testing.T) {
+func TestMedian(t *testing.T) {
 	tree := New()
+	if _, _, ok := tree.Median(); ok {
+		t.Fatal("expected false for the empty tree")
+	}
 
-	prev, exists := tree.Put([]byte{1}, []byte{1})
-	if prev != nil {
-		t.Fatal("previous value must be nil for the new key")
+	for n := 1; n <= 16; n++ {
+		tree.Put([]byte{byte(n)}, []byte{byte(n * 2)})
+
+		key, value, ok := tree.Median()
+		expected := byte((n + 1) / 2)
+		if !ok || key[0] != expected || value[0] != expected*2 {
+			t.Fatalf("size %d: expected median %d, but got %v, %v", n, expected, key, ok)
+		}
 	}
-	if exists {
-		t.Fatal("previous value must be nil for the new key")
+}
+
+func TestQuantile(t *testing.T) {
+	tree := New()
+	if _, _, ok := tree.Quantile(0.5); ok {
+		t.Fatal("expected false for the empty tree")
 	}
 
-	prev, exists = tree.Put([]byte{1}, []byte{2})
-	if !bytes.Equal(prev, []byte{1}) {
-		t.Fatalf("previous value must be %v, but got %v", []byte{1}, prev)
+	for k := 0; k <= 100; k++ {
+		tree.Put([]byte{byte(k)}, []byte{byte(k)})
 	}
-	if !exists {
-		t.Fatalf("exists must be true for key %v", []byte{1})
+
+	cases := []struct {
+		q        float64
+		expected byte
+	}{
+		{0, 0},
+		{0.25, 25},
+		{0.5, 50},
+		{0.994, 99},
+		{0.996, 100},
+		{1, 100},
+		{-1, 0},
+		{2, 100},
+		{math.Inf(1), 100},
 	}
 
-	value, ok := tree.Get([]byte{1})
-	if !ok {
-		t.Fatalf("key %d is not found, but must be overridden", 1)
+	for _, c := range cases {
+		key, value, ok := tree.Quantile(c.q)
+		if !ok || key[0] != c.expected || value[0] != c.expected {
+			t.Fatalf("q %v: expected %d, but got %v, %v", c.q, c.expected, key, ok)
+		}
 	}
 
-	if !bytes.Equal(value, []byte{2}) {
-		t.Fatalf("key %d is not overridden", 1)
+	if _, _, ok := tree.Quantile(math.NaN()); ok {
+		t.Fatal("expected false for NaN")
 	}
 }
 
-func TestGetForNonExistentValue(t *testing.T) {
+func TestSplitPoints(t *testing.T) {
 	tree := New()
+	for k := 0; k < 100; k++ {
+		tree.Put([]byte{byte(k)}, nil)
+	}
 
-	for _, c := range treeCases {
-		tree.Put([]byte{c.key}, []byte(c.value))
+	cases := []struct {
+		n        int
+		expected [][]byte
+	}{
+		{4, [][]byte{{25}, {50}, {75}}},
+		{3, [][]byte{{33}, {66}}},
+		{1, [][]byte{}},
+		{0, [][]byte{}},
 	}
 
-	value, ok := tree.Get([]byte{230})
-	if value != nil {
-		t.Fatalf("expected value to be nil, but got %s", value)
+	for _, c := range cases {
+		actual := tree.SplitPoints(c.n)
+		if !reflect.DeepEqual(c.expected, actual) {
+			t.Fatalf("n=%d: %v != %v", c.n, c.expected, actual)
+		}
 	}
-	if ok {
-		t.Fatalf("expected ok to be false, but got %v", ok)
+
+	small := New()
+	for k := 0; k < 3; k++ {
+		small.Put([]byte{byte(k)}, nil)
+	}
+
+	if actual := small.SplitPoints(8); !reflect.DeepEqual([][]byte{{1}, {2}}, actual) {
+		t.Fatalf("expected fewer points for the small tree, but got %v", actual)
+	}
+
+	if actual := New().SplitPoints(4); len(actual) != 0 {
+		t.Fatalf("expected no points for the empty tree, but got %v", actual)
 	}
 }
 
-func TestGetForEmptyTree(t *testing.T) {
+func TestOnChange(t *testing.T) {
 	tree := New()
 
-	value, ok := tree.Get([]byte{1})
-	if value != nil {
-		t.Fatalf("expected value to be nil, but got %s", value)
+	type change struct {
+		op    Op
+		key   string
+		value string
 	}
-	if ok {
-		t.Fatalf("expected ok to be false, but got %v", ok)
+	changes := make([]change, 0)
+	tree.OnChange(func(op Op, key, value []byte) {
+		changes = append(changes, change{op, string(key), string(value)})
+	})
+
+	tree.Put([]byte("a"), []byte("1"))
+	tree.Put([]byte("b"), []byte("2"))
+	tree.Put([]byte("a"), []byte("3"))
+	tree.Delete([]byte("b"))
+	tree.Delete([]byte("d"))
+
+	expected := []change{
+		{OpInsert, "a", "1"},
+		{OpInsert, "b", "2"},
+		{OpUpdate, "a", "3"},
+		{OpDelete, "b", "2"},
+	}
+	if !reflect.DeepEqual(expected, changes) {
+		t.Fatalf("%v != %v", expected, changes)
+	}
+
+	tree.OnChange(nil)
+	tree.Put([]byte("c"), []byte("4"))
+	if len(changes) != len(expected) {
+		t.Fatal("unregistered observer must not be called")
 	}
 }
 
-func TestForEach(t *testing.T) {
+func TestRetain(t *testing.T) {
+	cases := []struct {
+		lo      []byte
+		hi      []byte
+		removed int
+	}{
+		{[]byte{16}, []byte{32}, 240},
+		{nil, []byte{100}, 156},
+		{[]byte{100}, nil, 100},
+		{nil, nil, 0},
+		{[]byte{32}, []byte{16}, 256},
+	}
+
+	for _, c := range cases {
+		tree := New()
+		for k := 0; k < 256; k++ {
+			tree.Put([]byte{byte(k)}, []byte{byte(k)})
+		}
+
+		removed := tree.Retain(c.lo, c.hi)
+		if removed != c.removed {
+			t.Fatalf("[%v, %v): expected %d removed entries, but got %d", c.lo, c.hi, c.removed, removed)
+		}
+
+		if err := tree.Validate(); err != nil {
+			t.Fatalf("[%v, %v): tree is not valid after Retain: %s", c.lo, c.hi, err)
+		}
+		if tree.Size() != 256-c.removed {
+			t.Fatalf("[%v, %v): expected size %d, but got %d", c.lo, c.hi, 256-c.removed, tree.Size())
+		}
+
+		tree.ForEach(func(key, value []byte) {
+			if (c.lo != nil && bytes.Compare(key, c.lo) < 0) || (c.hi != nil && bytes.Compare(key, c.hi) >= 0) {
+				t.Fatalf("[%v, %v): key %v must be removed", c.lo, c.hi, key)
+			}
+		})
+	}
+}
+
+func TestRetainNotifiesDeletions(t *testing.T) {
 	tree := New()
-	for _, c := range treeCases {
-		tree.Put([]byte{c.key}, []byte(c.value))
+	for k := 0; k < 8; k++ {
+		tree.Put([]byte{byte(k)}, []byte{byte(k)})
 	}
 
-	actual := make([]byte, 0)
-	tree.ForEach(func(key []byte, value []byte) {
-		actual = append(actual, key...)
+	deleted := make([]byte, 0)
+	tree.OnChange(func(op Op, key, value []byte) {
+		if op == OpDelete {
+			deleted = append(deleted, key[0])
+		}
+		if _, ok := tree.Get(key); ok || tree.Size() != 4 {
+			t.Fatalf("expected key %d to be removed before the notification", key[0])
+		}
 	})
 
-	isSorted := sort.SliceIsSorted(actual, func(i, j int) bool {
-		return actual[i] < actual[j]
-	})
-	if !isSorted {
-		t.Fatalf("each does not traverse in sorted order, produced result: %s", actual)
+	tree.Retain([]byte{2}, []byte{6})
+
+	if !reflect.DeepEqual([]byte{0, 1, 6, 7}, deleted) {
+		t.Fatalf("unexpected deletions: %v", deleted)
 	}
+}
 
-	expected := make([]byte, 0)
+func TestCompact(t *testing.T) {
+	tree := New()
 	for _, c := range treeCases {
-		expected = append(expected, c.key)
+		value := make([]byte, len(c.value), 64)
+		copy(value, c.value)
+
+		tree.Put([]byte{c.key}, value)
 	}
-	sort.Slice(expected, func(i, j int) bool {
-		return expected[i] < expected[j]
-	})
+	tree.Put([]byte{100}, nil)
 
-	if !reflect.DeepEqual(expected, actual) {
-		t.Fatalf("%s != %s", expected, actual)
+	multi := NewMultiTree()
+	multi.Put([]byte{1}, make([]byte, 1, 8))
+	multi.Put([]byte{1}, make([]byte, 2, 8))
+
+	before := shape(tree.root)
+
+	tree.Compact()
+	multi.Compact()
+
+	if after := shape(tree.root); before != after {
+		t.Fatalf("structure must not change: %s != %s", before, after)
+	}
+
+	for _, c := range treeCases {
+		value, _ := tree.Get([]byte{c.key})
+		if string(value) != c.value {
+			t.Fatalf("expected value %s for key %d, but got %s", c.value, c.key, value)
+		}
+		if cap(value) != len(value) {
+			t.Fatalf("expected capacity %d for key %d, but got %d", len(value), c.key, cap(value))
+		}
+	}
+
+	if value, ok := tree.Get([]byte{100}); value != nil || !ok {
+		t.Fatalf("nil value must stay nil, but got %v", value)
+	}
+
+	for _, value := range multi.GetAll([]byte{1}) {
+		if cap(value) != len(value) {
+			t.Fatalf("expected capacity %d for duplicate value, but got %d", len(value), cap(value))
+		}
 	}
 }
 
-func TestForEachForEmptyTree(t *testing.T) {
-	tree := New()
+func TestSwap(t *testing.T) {
+	a := New()
+	for k := 0; k < 16; k++ {
+		a.Put([]byte{byte(k)}, []byte{byte(k)})
+	}
 
-	tree.ForEach(func(key []byte, value []byte) {
-		t.Fatal("call is not expected")
-	})
+	b := New()
+	for k := 100; k < 200; k++ {
+		b.Put([]byte{byte(k)}, []byte{byte(k)})
+	}
+
+	aEntries, bEntries := a.Entries(), b.Entries()
+
+	it := a.Iterator()
+
+	a.Swap(b)
+
+	if !reflect.DeepEqual(bEntries, a.Entries()) || !reflect.DeepEqual(aEntries, b.Entries()) {
+		t.Fatal("entries of the trees must be exchanged")
+	}
+
+	for _, tree := range []*Tree{a, b} {
+		if err := tree.Validate(); err != nil {
+			t.Fatalf("tree is not valid after swap: %s", err)
+		}
+	}
+
+	if a.Size() != 100 || b.Size() != 16 {
+		t.Fatalf("sizes must be exchanged, but got %d and %d", a.Size(), b.Size())
+	}
+
+	a.Put([]byte{50}, nil)
+	if _, ok := b.Get([]byte{50}); ok || b.Size() != 16 {
+		t.Fatal("trees must stay independent after swap")
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("iterator created before swap must panic")
+		}
+	}()
+
+	it.Next()
+}
+
+func TestSwapWithEmptyTree(t *testing.T) {
+	a := New()
+	a.Put([]byte{1}, nil)
+
+	b := New()
+	a.Swap(b)
+
+	if a.Size() != 0 || b.Size() != 1 {
+		t.Fatalf("expected sizes 0 and 1, but got %d and %d", a.Size(), b.Size())
+	}
+
+	for _, tree := range []*Tree{a, b} {
+		if err := tree.Validate(); err != nil {
+			t.Fatalf("tree is not valid after swap: %s", err)
+		}
+	}
 }
 
 func TestKeyOrder(t *testing.T) {
@@ -339,6 +3361,68 @@ func BenchmarkTreePut(b *testing.B) {
 	}
 }
 
+func BenchmarkTreePutAscending(b *testing.B) {
+	keys := make([][]byte, benchmarkKeyNum)
+	for k := range keys {
+		keys[k] = []byte(fmt.Sprintf("%08d", k))
+	}
+
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		BenchmarkTree = New()
+
+		for _, key := range keys {
+			BenchmarkTree.Put(key, key)
+		}
+	}
+}
+
+func BenchmarkTreePutDescending(b *testing.B) {
+	keys := make([][]byte, benchmarkKeyNum)
+	for k := range keys {
+		keys[k] = []byte(fmt.Sprintf("%08d", benchmarkKeyNum-k))
+	}
+
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		BenchmarkTree = New()
+
+		for _, key := range keys {
+			BenchmarkTree.Put(key, key)
+		}
+	}
+}
+
+func BenchmarkTreePutWithCapacity(b *testing.B) {
+	for n := 0; n < b.N; n++ {
+		BenchmarkTree = NewWithCapacity(benchmarkKeyNum)
+
+		for k := benchmarkKeyNum; k > 0; k-- {
+			key := strconv.Itoa(k)
+			BenchmarkTree.Put([]byte(key), []byte(key))
+		}
+	}
+}
+
+func BenchmarkTreePutBatchSmall(b *testing.B) {
+	tree := New()
+	for k := 0; k < 100000; k++ {
+		key := []byte(strconv.Itoa(k))
+		tree.Put(key, key)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		key := []byte(strconv.Itoa(n))
+		tree.PutBatch(func(put func(key, value []byte)) {
+			put(key, key)
+		})
+	}
+}
+
 func BenchmarkMapPut(b *testing.B) {
 	for n := 0; n < b.N; n++ {
 		BenchmarkMap = make(map[string][]byte)
@@ -411,6 +3495,38 @@ func BenchmarkTreeGet(b *testing.B) {
 	}
 }
 
+func BenchmarkTreeForEach(b *testing.B) {
+	BenchmarkTree = New()
+	for k := benchmarkKeyNum; k > 0; k-- {
+		key := strconv.Itoa(k)
+		BenchmarkTree.Put([]byte(key), []byte(key))
+	}
+
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		BenchmarkTree.ForEach(func(k, v []byte) {
+			BenchmarkValue = v
+		})
+	}
+}
+
+func BenchmarkTreeForEachNode(b *testing.B) {
+	BenchmarkTree = New()
+	for k := benchmarkKeyNum; k > 0; k-- {
+		key := strconv.Itoa(k)
+		BenchmarkTree.Put([]byte(key), []byte(key))
+	}
+
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		BenchmarkTree.ForEachNode(func(k, v []byte, isBlack bool, depth int) {
+			BenchmarkValue = v
+		})
+	}
+}
+
 func BenchmarkTreePutAndForEach(b *testing.B) {
 	for n := 0; n < b.N; n++ {
 		BenchmarkTree = New()
@@ -0,0 +1,132 @@
+package rbytree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// Validate checks that the tree is a valid binary search tree
+// satisfying the red-black tree properties and returns an error
+// describing the first violation found, or nil.
+func (t *Tree) Validate() error {
+	if t.root == nil {
+		if t.size != 0 {
+			return fmt.Errorf("empty tree reports size %d", t.size)
+		}
+		if t.leftmost != nil || t.rightmost != nil {
+			return errors.New("empty tree caches leftmost or rightmost node")
+		}
+
+		return nil
+	}
+
+	if t.root.color != black {
+		return errors.New("root is not black")
+	}
+
+	if t.root.parent != nil {
+		return errors.New("root has a parent")
+	}
+
+	count, _, err := validateNode(t.root, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	if count != t.size {
+		return fmt.Errorf("tree holds %d nodes, but reports size %d", count, t.size)
+	}
+
+	if t.leftmost != minimum(t.root) || t.rightmost != maximum(t.root) {
+		return errors.New("cached leftmost or rightmost node is stale")
+	}
+
+	tombstones := 0
+	for current := t.leftmost; current != nil; current = successor(current) {
+		if current.deleted {
+			tombstones++
+		}
+	}
+	if tombstones != t.tombstones {
+		return fmt.Errorf("tree holds %d tombstoned nodes, but reports %d", tombstones, t.tombstones)
+	}
+
+	return nil
+}
+
+// validateNode validates the subtree rooted at n, whose keys must lie
+// strictly between the keys of lower and upper (nil means unbounded),
+// and returns the number of nodes and the black height of the subtree.
+func validateNode(n *node, lower, upper *node) (int, int, error) {
+	if n == nil {
+		return 0, 1, nil
+	}
+
+	if lower != nil && bytes.Compare(n.key, lower.key) <= 0 {
+		return 0, 0, fmt.Errorf("key %v is not greater than key %v", n.key, lower.key)
+	}
+	if upper != nil && bytes.Compare(n.key, upper.key) >= 0 {
+		return 0, 0, fmt.Errorf("key %v is not less than key %v", n.key, upper.key)
+	}
+
+	if (n.left != nil && n.left.parent != n) || (n.right != nil && n.right.parent != n) {
+		return 0, 0, fmt.Errorf("child of node %v does not point to it as the parent", n.key)
+	}
+
+	if n.color == red {
+		if (n.left != nil && n.left.color == red) || (n.right != nil && n.right.color == red) {
+			return 0, 0, fmt.Errorf("red node %v has a red child", n.key)
+		}
+	}
+
+	leftCount, leftHeight, err := validateNode(n.left, lower, n)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	rightCount, rightHeight, err := validateNode(n.right, n, upper)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if leftHeight != rightHeight {
+		return 0, 0, fmt.Errorf("black heights of the subtrees of node %v differ: %d != %d", n.key, leftHeight, rightHeight)
+	}
+
+	count := leftCount + rightCount + 1
+	if n.size != count {
+		return 0, 0, fmt.Errorf("node %v holds %d nodes in its subtree, but reports size %d", n.key, count, n.size)
+	}
+
+	height := leftHeight
+	if n.color == black {
+		height++
+	}
+
+	return count, height, nil
+}
+
+// RepairParents walks the tree from the root and rewrites the parent
+// pointer of each node to match the structure of the tree.
+// It is a no-op for a correctly built tree.
+func (t *Tree) RepairParents() {
+	if t.root == nil {
+		return
+	}
+
+	t.root.parent = nil
+	repairParents(t.root)
+}
+
+func repairParents(n *node) {
+	if n.left != nil {
+		n.left.parent = n
+		repairParents(n.left)
+	}
+
+	if n.right != nil {
+		n.right.parent = n
+		repairParents(n.right)
+	}
+}
@@ -0,0 +1,98 @@
+package rbytree
+
+import (
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tree := New()
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("empty tree must be valid, but got: %s", err)
+	}
+
+	for k := 0; k < 256; k++ {
+		tree.Put([]byte{byte(k)}, []byte{byte(k)})
+
+		if err := tree.Validate(); err != nil {
+			t.Fatalf("tree must be valid after inserting %d, but got: %s", k, err)
+		}
+	}
+}
+
+func TestValidateDetectsViolations(t *testing.T) {
+	cases := []struct {
+		name   string
+		breaks func(tree *Tree)
+	}{
+		{"red root", func(tree *Tree) {
+			tree.root.color = red
+		}},
+		{"adjacent red nodes", func(tree *Tree) {
+			tree.root.left.color = red
+			tree.root.left.left.color = red
+		}},
+		{"black height", func(tree *Tree) {
+			tree.root.left.color = red
+		}},
+		{"key order", func(tree *Tree) {
+			tree.root.left.key = []byte{255}
+		}},
+		{"size", func(tree *Tree) {
+			tree.size++
+		}},
+		{"subtree size", func(tree *Tree) {
+			tree.root.left.size++
+		}},
+		{"rightmost node", func(tree *Tree) {
+			tree.rightmost = tree.root
+		}},
+		{"root parent", func(tree *Tree) {
+			tree.root.parent = tree.root.left
+		}},
+		{"parent pointer", func(tree *Tree) {
+			tree.root.left.left.parent = tree.root
+		}},
+		{"tombstones", func(tree *Tree) {
+			tree.root.deleted = true
+		}},
+	}
+
+	for _, c := range cases {
+		tree := New()
+		for _, tc := range treeCases {
+			tree.Put([]byte{tc.key}, []byte(tc.value))
+		}
+
+		c.breaks(tree)
+
+		if err := tree.Validate(); err == nil {
+			t.Fatalf("expected violation %q to be detected", c.name)
+		}
+	}
+}
+
+func TestRepairParents(t *testing.T) {
+	tree := New()
+	tree.RepairParents()
+
+	for _, c := range treeCases {
+		tree.Put([]byte{c.key}, []byte(c.value))
+	}
+
+	tree.RepairParents()
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("RepairParents must be a no-op for the valid tree, but got: %s", err)
+	}
+
+	tree.root.parent = tree.root.right
+	tree.root.left.parent = nil
+	tree.root.right.right.parent = tree.root
+	if err := tree.Validate(); err == nil {
+		t.Fatal("expected broken parent pointers to be detected")
+	}
+
+	tree.RepairParents()
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("tree is not valid after RepairParents: %s", err)
+	}
+}
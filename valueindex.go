@@ -0,0 +1,125 @@
+package rbytree
+
+import (
+	"bytes"
+	"hash/fnv"
+	"sort"
+)
+
+// NewWithValueIndex creates new empty instance of Red-black tree that
+// maintains a secondary index from the hashes of the values to the keys
+// holding them, so that KeysForValue does not scan the tree.
+// The index holds a copy of every key, so it roughly doubles the memory
+// taken by the keys. Values modified in place bypass the index, replace
+// them with Put or ForEachMutable instead.
+func NewWithValueIndex() *Tree {
+	return &Tree{valueIndex: make(map[uint64]map[string]int)}
+}
+
+// KeysForValue returns copies of the keys holding the value, or any of
+// their values for a multi tree, in ascending key order. It returns nil
+// unless the tree is created with NewWithValueIndex.
+func (t *Tree) KeysForValue(value []byte) [][]byte {
+	if t.valueIndex == nil {
+		return nil
+	}
+
+	keys := make([][]byte, 0)
+	for key := range t.valueIndex[hashValue(value)] {
+		// different values might have the same hash
+		n := t.getNode([]byte(key))
+		if n != nil && holdsValue(n, value) {
+			keys = append(keys, []byte(key))
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+
+	return keys
+}
+
+func holdsValue(n *node, value []byte) bool {
+	if bytes.Equal(n.value, value) {
+		return true
+	}
+
+	for _, duplicate := range n.duplicates {
+		if bytes.Equal(duplicate, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// indexValue adds the key to the index of the value if it is maintained.
+func (t *Tree) indexValue(key, value []byte) {
+	if t.valueIndex == nil {
+		return
+	}
+
+	h := hashValue(value)
+	keys := t.valueIndex[h]
+	if keys == nil {
+		keys = make(map[string]int)
+		t.valueIndex[h] = keys
+	}
+	keys[string(key)]++
+}
+
+// unindexValue removes the key from the index of the value
+// if it is maintained.
+func (t *Tree) unindexValue(key, value []byte) {
+	if t.valueIndex == nil {
+		return
+	}
+
+	h := hashValue(value)
+	keys := t.valueIndex[h]
+	if keys[string(key)] > 1 {
+		keys[string(key)]--
+		return
+	}
+
+	delete(keys, string(key))
+	if len(keys) == 0 {
+		delete(t.valueIndex, h)
+	}
+}
+
+// unindexNode removes the key from the indexes of all the values
+// of the node if the index is maintained.
+func (t *Tree) unindexNode(n *node) {
+	if t.valueIndex == nil || n.deleted {
+		return
+	}
+
+	t.unindexValue(n.key, n.value)
+	for _, duplicate := range n.duplicates {
+		t.unindexValue(n.key, duplicate)
+	}
+}
+
+// resetValueIndex rebuilds the value index if it is maintained.
+func (t *Tree) resetValueIndex() {
+	if t.valueIndex == nil {
+		return
+	}
+
+	t.valueIndex = make(map[uint64]map[string]int)
+	t.traverse(func(n *node) {
+		t.indexValue(n.key, n.value)
+		for _, duplicate := range n.duplicates {
+			t.indexValue(n.key, duplicate)
+		}
+	})
+}
+
+func hashValue(value []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(value)
+
+	return h.Sum64()
+}
@@ -0,0 +1,90 @@
+package rbytree
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNewWithValueIndex(t *testing.T) {
+	tree := NewWithValueIndex()
+
+	expectKeys := func(value string, expected ...string) {
+		keys := make([]string, 0)
+		for _, key := range tree.KeysForValue([]byte(value)) {
+			keys = append(keys, string(key))
+		}
+
+		if expected == nil {
+			expected = []string{}
+		}
+		if !reflect.DeepEqual(keys, expected) {
+			t.Fatalf("value %s: expected keys %v, but got %v", value, expected, keys)
+		}
+	}
+
+	tree.Put([]byte("c"), []byte("x"))
+	tree.Put([]byte("a"), []byte("x"))
+	tree.Put([]byte("b"), []byte("y"))
+	expectKeys("x", "a", "c")
+	expectKeys("y", "b")
+	expectKeys("z")
+
+	tree.Put([]byte("a"), []byte("y"))
+	expectKeys("x", "c")
+	expectKeys("y", "a", "b")
+
+	tree.Delete([]byte("b"))
+	expectKeys("y", "a")
+
+	tree.Replace([]byte("a"), []byte("z"))
+	expectKeys("y")
+	expectKeys("z", "a")
+
+	tree.CompareAndSwap([]byte("a"), []byte("z"), []byte("x"))
+	expectKeys("z")
+	expectKeys("x", "a", "c")
+
+	tree.TransformValues(func(key, value []byte) []byte {
+		return append([]byte(nil), key...)
+	})
+	expectKeys("x")
+	expectKeys("a", "a")
+	expectKeys("c", "c")
+
+	tree.Put([]byte("b"), []byte("a"))
+	tree.Rebuild()
+	expectKeys("a", "a", "b")
+
+	tree.Remove([]byte("a"))
+	expectKeys("a", "b")
+}
+
+func TestNewWithValueIndexForMultiTree(t *testing.T) {
+	tree := NewWithValueIndex()
+	tree.multi = true
+
+	tree.Put([]byte("a"), []byte("x"))
+	tree.Put([]byte("a"), []byte("y"))
+	tree.Put([]byte("a"), []byte("x"))
+
+	if keys := tree.KeysForValue([]byte("y")); len(keys) != 1 || string(keys[0]) != "a" {
+		t.Fatalf("expected key a for the duplicate value, but got %q", keys)
+	}
+
+	tree.Delete([]byte("a"))
+	if keys := tree.KeysForValue([]byte("x")); len(keys) != 0 {
+		t.Fatalf("expected no keys after deletion, but got %q", keys)
+	}
+	if len(tree.valueIndex) != 0 {
+		t.Fatalf("expected empty index, but got %v", tree.valueIndex)
+	}
+}
+
+func TestKeysForValueWithoutIndex(t *testing.T) {
+	tree := New()
+	tree.Put([]byte("a"), []byte("x"))
+
+	if keys := tree.KeysForValue([]byte("x")); keys != nil {
+		t.Fatalf("expected nil without the index, but got %q", keys)
+	}
+}